@@ -82,3 +82,14 @@ func (a *Allocator) Free(addr uint64) {
 	machine.Linearize()
 	a.m.Unlock()
 }
+
+// NumFree returns the number of free blocks.
+func (a *Allocator) NumFree() uint64 {
+	a.m.Lock()
+	n := uint64(len(a.free))
+	a.m.Unlock()
+	return n
+}
+
+// Flush does nothing, since the Allocator does not store its state durably.
+func (a *Allocator) Flush() {}
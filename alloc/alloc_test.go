@@ -4,6 +4,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/mit-pdos/perennial-examples/storage"
+	"github.com/mit-pdos/perennial-examples/storage/storagetest"
 )
 
 func TestAllocatorReservationUnique(t *testing.T) {
@@ -49,3 +52,11 @@ func TestAllocatorFree(t *testing.T) {
 	assert.True(a == 2 || a == 3,
 		"new address {} should be freed", a)
 }
+
+func TestAllocatorConformance(t *testing.T) {
+	storagetest.TestAllocator(t, storagetest.AllocImpl{
+		New: func(n uint64) (storage.Allocator, func() storage.Allocator) {
+			return New(1, n, AddrSet{}), nil
+		},
+	})
+}
@@ -99,6 +99,18 @@ func (a *Alloc) FreeNum(num uint64) {
 	a.freeBit(num)
 }
 
+// Reserve allocates a number, like AllocNum, but reports failure with false
+// rather than 0.
+func (a *Alloc) Reserve() (uint64, bool) {
+	num := a.AllocNum()
+	return num, num != 0
+}
+
+// Free is the same as FreeNum.
+func (a *Alloc) Free(num uint64) {
+	a.FreeNum(num)
+}
+
 func (a *Alloc) Flush() {
 	a.mu.Lock()
 	if a.dirty {
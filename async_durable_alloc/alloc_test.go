@@ -5,6 +5,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/tchajed/goose/machine/async_disk"
+
+	"github.com/mit-pdos/perennial-examples/storage"
+	"github.com/mit-pdos/perennial-examples/storage/storagetest"
 )
 
 func TestPopCnt(t *testing.T) {
@@ -50,3 +53,20 @@ func TestAlloc(t *testing.T) {
 	assert.NotEqual(n+1, n3, "should not allocate something marked used")
 
 }
+
+func TestAllocConformance(t *testing.T) {
+	storagetest.TestAllocator(t, storagetest.AllocImpl{
+		New: func(n uint64) (storage.Allocator, func() storage.Allocator) {
+			d := async_disk.NewMemDisk(1)
+			a := MkAlloc(d, 0)
+			// only numbers 1 through n are free
+			a.MarkUsed(0)
+			for bn := n + 1; bn < 8*async_disk.BlockSize; bn++ {
+				a.MarkUsed(bn)
+			}
+			a.Flush()
+			reopen := func() storage.Allocator { return MkAlloc(d, 0) }
+			return a, reopen
+		},
+	})
+}
@@ -6,7 +6,8 @@ import (
 	"github.com/tchajed/goose/machine/async_disk"
 	"github.com/tchajed/marshal"
 
-	"github.com/mit-pdos/perennial-examples/async_durable_alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
 )
 
 // Maximum size of inode, in blocks.
@@ -93,12 +94,19 @@ func (i *Inode) append(a uint64) bool {
 	return true
 }
 
-// Append adds a block to the inode.
+// AppendErr adds a block to the inode.
 //
-// Returns false on failure (if the allocator or inode are out of space)
-func (i *Inode) Append(b async_disk.Block, allocator *async_alloc.Alloc) bool {
+// Returns errs.ErrInodeFull if the inode is at MaxBlocks, or errs.ErrNoSpace
+// if the allocator is out of space.
+func (i *Inode) AppendErr(b async_disk.Block, allocator storage.Allocator) error {
+	if i.Size() >= MaxBlocks {
+		return errs.ErrInodeFull
+	}
 	// allocate lock-free
-	a := allocator.AllocNum()
+	a, ok := allocator.Reserve()
+	if !ok {
+		return errs.ErrNoSpace
+	}
 	// prepare lock-free
 	i.d.Write(a, b)
 	allocator.Flush()
@@ -108,7 +116,22 @@ func (i *Inode) Append(b async_disk.Block, allocator *async_alloc.Alloc) bool {
 	ok2 := i.append(a)
 	i.m.Unlock()
 	if !ok2 {
-		allocator.FreeNum(a)
+		// another append filled up the inode concurrently
+		allocator.Free(a)
+		return errs.ErrInodeFull
 	}
-	return ok2
+	return nil
+}
+
+// Append adds a block to the inode.
+//
+// Returns false on failure (if the allocator or inode are out of space)
+func (i *Inode) Append(b async_disk.Block, allocator storage.Allocator) bool {
+	return i.AppendErr(b, allocator) == nil
+}
+
+// FlushErr does nothing, since AppendErr makes each block durable before
+// returning.
+func (i *Inode) FlushErr(allocator storage.Allocator) error {
+	return nil
 }
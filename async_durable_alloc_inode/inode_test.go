@@ -7,6 +7,9 @@ import (
 	"github.com/tchajed/goose/machine/async_disk"
 
 	"github.com/mit-pdos/perennial-examples/async_durable_alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
+	"github.com/mit-pdos/perennial-examples/storage/storagetest"
 )
 
 func makeBlock(x byte) async_disk.Block {
@@ -44,6 +47,7 @@ func TestInodeAppendFill(t *testing.T) {
 	assert.Equal(false,
 		ino.Append(makeBlock(0), allocator),
 		"should not allow appending past InodeMaxBlocks")
+	assert.Equal(errs.ErrInodeFull, ino.AppendErr(makeBlock(0), allocator))
 }
 
 func TestInodeRecover(t *testing.T) {
@@ -60,3 +64,24 @@ func TestInodeRecover(t *testing.T) {
 	assert.Equal(makeBlock(2), i.Read(1))
 	assert.Len(i.UsedBlocks(), 2)
 }
+
+func TestInodeConformance(t *testing.T) {
+	storagetest.TestInode(t, storagetest.Impl{
+		MaxBlocks: MaxBlocks,
+		New: func(numBlocks uint64) storagetest.Instance {
+			d := async_disk.NewMemDisk(2 + numBlocks)
+			allocator := async_alloc.MkAlloc(d, 1)
+			allocator.MarkUsed(0)
+			allocator.MarkUsed(1)
+			// the bitmap covers more numbers than there are blocks
+			for bn := 2 + numBlocks; bn < 8*async_disk.BlockSize; bn++ {
+				allocator.MarkUsed(bn)
+			}
+			return storagetest.Instance{
+				Inode:     Open(d, 0),
+				Allocator: allocator,
+				Reopen:    func() storage.Inode { return Open(d, 0) },
+			}
+		},
+	})
+}
@@ -6,7 +6,8 @@ import (
 	"github.com/tchajed/goose/machine/disk"
 	"github.com/tchajed/marshal"
 
-	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
 )
 
 // Maximum size of inode, in blocks.
@@ -88,7 +89,7 @@ func (i *Inode) appendOne(a uint64) {
 // flushOne extends the on-disk inode with the next buffered write
 //
 // assumes lock is held and that there is at least one buffered write
-func (i *Inode) flushOne(allocator *alloc.Allocator) bool {
+func (i *Inode) flushOne(allocator storage.Allocator) bool {
 	a, ok := allocator.Reserve()
 	if !ok {
 		return false
@@ -96,6 +97,7 @@ func (i *Inode) flushOne(allocator *alloc.Allocator) bool {
 	b := i.buffered[0]
 	i.buffered = i.buffered[1:]
 	i.d.Write(a, b)
+	allocator.Flush()
 	i.appendOne(a)
 	return true
 }
@@ -103,7 +105,7 @@ func (i *Inode) flushOne(allocator *alloc.Allocator) bool {
 // critical section for Flush
 //
 // assumes lock is held
-func (i *Inode) flush(allocator *alloc.Allocator) bool {
+func (i *Inode) flush(allocator storage.Allocator) bool {
 	for len(i.buffered) > 0 {
 		ok := i.flushOne(allocator)
 		if !ok {
@@ -116,14 +118,25 @@ func (i *Inode) flush(allocator *alloc.Allocator) bool {
 	return true
 }
 
-// Flush persists all allocated data atomically
+// FlushErr persists all allocated data atomically
 //
-// returns false on allocator failure
-func (i *Inode) Flush(allocator *alloc.Allocator) bool {
+// returns errs.ErrNoSpace on allocator failure, in which case only some of
+// the buffered blocks were persisted
+func (i *Inode) FlushErr(allocator storage.Allocator) error {
 	i.m.Lock()
 	ok := i.flush(allocator)
 	i.m.Unlock()
-	return ok
+	if !ok {
+		return errs.ErrNoSpace
+	}
+	return nil
+}
+
+// Flush persists all allocated data atomically
+//
+// returns false on allocator failure
+func (i *Inode) Flush(allocator storage.Allocator) bool {
+	return i.FlushErr(allocator) == nil
 }
 
 // assumes lock is held
@@ -136,12 +149,24 @@ func (i *Inode) append(b disk.Block) bool {
 	return true
 }
 
-// Append adds a block to the inode, without making it persistent.
+// AppendErr adds a block to the inode, without making it persistent.
 //
-// Returns false on failure (if the allocator or inode are out of space)
-func (i *Inode) Append(b disk.Block) bool {
+// Returns errs.ErrInodeFull if the inode is at MaxBlocks. Blocks are only
+// allocated by Flush, so allocator is unused and running out of space is only
+// detected by Flush.
+func (i *Inode) AppendErr(b disk.Block, allocator storage.Allocator) error {
 	i.m.Lock()
 	ok := i.append(b)
 	i.m.Unlock()
-	return ok
+	if !ok {
+		return errs.ErrInodeFull
+	}
+	return nil
+}
+
+// Append adds a block to the inode, without making it persistent.
+//
+// Returns false on failure (if the allocator or inode are out of space)
+func (i *Inode) Append(b disk.Block) bool {
+	return i.AppendErr(b, nil) == nil
 }
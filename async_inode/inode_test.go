@@ -7,6 +7,9 @@ import (
 	"github.com/tchajed/goose/machine/disk"
 
 	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
+	"github.com/mit-pdos/perennial-examples/storage/storagetest"
 )
 
 func makeBlock(x byte) disk.Block {
@@ -52,6 +55,19 @@ func TestInodeAppendFill(t *testing.T) {
 	assert.Equal(false,
 		ino.Append(makeBlock(0)),
 		"should not allow appending past InodeMaxBlocks")
+	assert.Equal(errs.ErrInodeFull, ino.AppendErr(makeBlock(0), nil))
+}
+
+func TestInodeFlushErr(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(2)
+	allocator := alloc.New(1, 1, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.AppendErr(makeBlock(1), allocator))
+	assert.NoError(ino.AppendErr(makeBlock(2), allocator))
+	assert.Equal(errs.ErrNoSpace, ino.FlushErr(allocator))
+	assert.Len(ino.UsedBlocks(), 1, "first block should still be flushed")
+	assert.Equal(uint64(2), ino.Size())
 }
 
 func TestInodeRecover(t *testing.T) {
@@ -67,3 +83,17 @@ func TestInodeRecover(t *testing.T) {
 	assert.Equal(makeBlock(2), i.Read(1))
 	assert.Len(i.UsedBlocks(), 2)
 }
+
+func TestInodeConformance(t *testing.T) {
+	storagetest.TestInode(t, storagetest.Impl{
+		MaxBlocks: MaxBlocks,
+		New: func(numBlocks uint64) storagetest.Instance {
+			d := disk.NewMemDisk(1 + numBlocks)
+			return storagetest.Instance{
+				Inode:     Open(d, 0),
+				Allocator: alloc.New(1, numBlocks, alloc.AddrSet{}),
+				Reopen:    func() storage.Inode { return Open(d, 0) },
+			}
+		},
+	})
+}
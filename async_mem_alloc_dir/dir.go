@@ -3,6 +3,7 @@ package dir
 import (
 	"github.com/mit-pdos/perennial-examples/alloc"
 	"github.com/mit-pdos/perennial-examples/async_mem_alloc_inode"
+	"github.com/mit-pdos/perennial-examples/errs"
 	"github.com/tchajed/goose/machine/async_disk"
 )
 
@@ -51,7 +52,18 @@ func (d *Dir) Size(ino uint64) uint64 {
 	return i.Size()
 }
 
-func (d *Dir) Append(ino uint64, b async_disk.Block) bool {
+// AppendErr adds a block to inode ino.
+//
+// Returns errs.ErrInvalidInode if ino >= NumInodes, and otherwise fails like
+// async_mem_alloc_inode.Inode.AppendErr.
+func (d *Dir) AppendErr(ino uint64, b async_disk.Block) error {
+	if ino >= NumInodes {
+		return errs.ErrInvalidInode
+	}
 	i := d.inodes[ino]
-	return i.Append(b, d.allocator)
+	return i.AppendErr(b, d.allocator)
+}
+
+func (d *Dir) Append(ino uint64, b async_disk.Block) bool {
+	return d.AppendErr(ino, b) == nil
 }
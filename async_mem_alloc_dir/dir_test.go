@@ -5,6 +5,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/tchajed/goose/machine/async_disk"
+
+	"github.com/mit-pdos/perennial-examples/errs"
 )
 
 func makeBlock(x byte) async_disk.Block {
@@ -54,4 +56,13 @@ func TestDirRecoverFull(t *testing.T) {
 	dir = Open(theDisk, theDisk.Size())
 	ok := dir.Append(2, makeBlock(3))
 	assert.False(ok, "should be no space to add more blocks")
+	assert.Equal(errs.ErrNoSpace, dir.AppendErr(2, makeBlock(3)))
+}
+
+func TestDirAppendInvalid(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := async_disk.NewMemDisk(NumInodes + 2)
+	dir := Open(theDisk, theDisk.Size())
+	assert.Equal(errs.ErrInvalidInode, dir.AppendErr(NumInodes, makeBlock(1)))
+	assert.False(dir.Append(NumInodes, makeBlock(1)))
 }
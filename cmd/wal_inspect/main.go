@@ -0,0 +1,224 @@
+// Command wal_inspect dumps the write-ahead log stored in a disk image,
+// showing what recovery would replay.
+//
+// Usage:
+//
+//	wal_inspect [-json] [-log-start N] [-log-size N] [-data data.img] log.img
+//
+// By default the log is expected where wal.DefaultOptions puts it. If the log
+// was opened with wal.OpenSplit, pass the data disk image with -data so the
+// logged blocks can be compared against their home locations; the log is then
+// expected where wal.DefaultSplitOptions puts it, filling the log image. Use
+// -log-start and -log-size for any other layout.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/wal"
+)
+
+type entryReport struct {
+	Pos     uint64 `json:"pos"`
+	LogAddr uint64 `json:"log_addr"`
+	Addr    uint64 `json:"addr"`
+	Digest  string `json:"digest"`
+	// replaying this entry would change the block at Addr
+	Changes bool `json:"changes"`
+	// a later entry in the log also writes Addr
+	Superseded bool `json:"superseded"`
+}
+
+type report struct {
+	HdrAddr uint64        `json:"hdr_addr"`
+	Start   uint64        `json:"start"`
+	End     uint64        `json:"end"`
+	Entries []entryReport `json:"entries"`
+}
+
+func digest(b disk.Block) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// mkReport describes state, comparing logged blocks against the current
+// contents of dataDisk
+func mkReport(state *wal.LogState, dataDisk disk.Disk) report {
+	lastWrite := make(map[uint64]int)
+	for i, e := range state.Entries {
+		lastWrite[e.Addr] = i
+	}
+	entries := make([]entryReport, 0, len(state.Entries))
+	for i, e := range state.Entries {
+		var changes = false
+		if e.Addr < dataDisk.Size() {
+			changes = !bytes.Equal(e.Block, dataDisk.Read(e.Addr))
+		}
+		entries = append(entries, entryReport{
+			Pos:        e.Pos,
+			LogAddr:    e.LogAddr,
+			Addr:       e.Addr,
+			Digest:     digest(e.Block),
+			Changes:    changes,
+			Superseded: lastWrite[e.Addr] != i,
+		})
+	}
+	return report{
+		HdrAddr: state.HdrAddr,
+		Start:   state.Start,
+		End:     state.End,
+		Entries: entries,
+	}
+}
+
+func (r report) writeText(w io.Writer) {
+	fmt.Fprintf(w, "header at block %d: start=%d end=%d (%d blocks, %d updates)\n",
+		r.HdrAddr, r.Start, r.End, r.End-r.Start, len(r.Entries))
+	if len(r.Entries) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "POS\tLOG BLOCK\tADDR\tDIGEST\tREPLAY")
+	for _, e := range r.Entries {
+		replay := "no change"
+		if e.Changes {
+			replay = "changes home"
+		}
+		if e.Superseded {
+			replay += " (superseded)"
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\n",
+			e.Pos, e.LogAddr, e.Addr, e.Digest, replay)
+	}
+	tw.Flush()
+}
+
+// imageDisk is a read-only disk backed by an image file, so inspecting an
+// image never modifies it (not even its mtime)
+type imageDisk struct {
+	f         *os.File
+	numBlocks uint64
+}
+
+func (d imageDisk) ReadTo(a uint64, buf disk.Block) {
+	if uint64(len(buf)) != disk.BlockSize {
+		panic("buffer is not block-sized")
+	}
+	if a >= d.numBlocks {
+		panic(fmt.Errorf("out-of-bounds read at %v", a))
+	}
+	_, err := d.f.ReadAt(buf, int64(a*disk.BlockSize))
+	if err != nil {
+		panic("read failed: " + err.Error())
+	}
+}
+
+func (d imageDisk) Read(a uint64) disk.Block {
+	buf := make(disk.Block, disk.BlockSize)
+	d.ReadTo(a, buf)
+	return buf
+}
+
+func (d imageDisk) Write(a uint64, v disk.Block) {
+	panic("wal_inspect: image is read-only")
+}
+
+func (d imageDisk) Size() uint64 {
+	return d.numBlocks
+}
+
+func (d imageDisk) Barrier() {}
+
+func (d imageDisk) Close() {
+	d.f.Close()
+}
+
+func openImage(path string) (disk.Disk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if uint64(info.Size())%disk.BlockSize != 0 {
+		f.Close()
+		return nil, fmt.Errorf("%s: size %d is not a multiple of the block size",
+			path, info.Size())
+	}
+	return imageDisk{f: f, numBlocks: uint64(info.Size()) / disk.BlockSize}, nil
+}
+
+// layout returns the options describing where the log is, defaulting to
+// wal.DefaultSplitOptions if the data is on a separate disk and
+// wal.DefaultOptions otherwise; logStart and logSize override the defaults if
+// non-negative
+func layout(logDisk disk.Disk, dataDisk disk.Disk, split bool, logStart int64, logSize int64) wal.Options {
+	var opts = wal.DefaultOptions(logDisk)
+	if split {
+		opts = wal.DefaultSplitOptions(logDisk, dataDisk)
+	}
+	if logStart >= 0 {
+		opts.LogStart = uint64(logStart)
+	}
+	if logSize >= 0 {
+		opts.LogSize = uint64(logSize)
+	}
+	return opts
+}
+
+func main() {
+	jsonOutput := flag.Bool("json", false, "print JSON instead of text")
+	logStart := flag.Int64("log-start", -1, "address of the log header (default from wal.DefaultOptions, or wal.DefaultSplitOptions with -data)")
+	logSize := flag.Int64("log-size", -1, "number of log blocks (default from wal.DefaultOptions, or wal.DefaultSplitOptions with -data)")
+	dataPath := flag.String("data", "", "separate data disk image (default: the log image)")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: wal_inspect [flags] log.img")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	logDisk, err := openImage(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer logDisk.Close()
+	var dataDisk = logDisk
+	if *dataPath != "" {
+		dataDisk, err = openImage(*dataPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer dataDisk.Close()
+	}
+
+	opts := layout(logDisk, dataDisk, *dataPath != "", *logStart, *logSize)
+	state, err := wal.Inspect(logDisk, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	r := mkReport(state, dataDisk)
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+		return
+	}
+	r.writeText(os.Stdout)
+}
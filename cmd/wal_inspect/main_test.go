@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/wal"
+)
+
+func mkBlock(b0 byte) disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	b[0] = b0
+	return b
+}
+
+func TestReport(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := wal.Open(d)
+	log.Write([]wal.Update{
+		{Addr: 600, Block: mkBlock(1)},
+		{Addr: 601, Block: mkBlock(2)},
+	})
+	log.Write([]wal.Update{{Addr: 600, Block: mkBlock(3)}})
+	log.Close()
+	// pretend the last write to 601 was never installed
+	d.Write(601, mkBlock(0))
+
+	state, err := wal.Inspect(d, wal.DefaultOptions(d))
+	assert.NoError(err)
+	r := mkReport(state, d)
+	assert.Len(r.Entries, 3)
+	assert.Equal(uint64(600), r.Entries[0].Addr)
+	assert.True(r.Entries[0].Superseded)
+	assert.True(r.Entries[0].Changes, "home has the newer value")
+	assert.Equal(uint64(601), r.Entries[1].Addr)
+	assert.True(r.Entries[1].Changes)
+	assert.False(r.Entries[1].Superseded)
+	assert.False(r.Entries[2].Changes, "last write to 600 is installed")
+	assert.Equal(digest(mkBlock(3)), r.Entries[2].Digest)
+
+	var buf bytes.Buffer
+	r.writeText(&buf)
+	assert.Contains(buf.String(), "start=0 end=5")
+	assert.Contains(buf.String(), "changes home (superseded)")
+}
+
+func TestReportSplit(t *testing.T) {
+	assert := assert.New(t)
+	logDisk := disk.NewMemDisk(20)
+	dataDisk := disk.NewMemDisk(100)
+	log, err := wal.OpenSplit(logDisk, dataDisk,
+		wal.DefaultSplitOptions(logDisk, dataDisk))
+	assert.NoError(err)
+	log.Write([]wal.Update{{Addr: 5, Block: mkBlock(1)}})
+	log.Close()
+
+	// the default (non-split) layout does not fit on this log disk
+	_, err = wal.Inspect(logDisk, layout(logDisk, logDisk, false, -1, -1))
+	assert.True(errors.Is(err, wal.ErrInvalidLayout))
+
+	state, err := wal.Inspect(logDisk, layout(logDisk, dataDisk, true, -1, -1))
+	assert.NoError(err)
+	r := mkReport(state, dataDisk)
+	assert.Len(r.Entries, 1)
+	assert.Equal(uint64(5), r.Entries[0].Addr)
+	assert.False(r.Entries[0].Changes, "write should be installed")
+
+	opts := layout(logDisk, dataDisk, true, 2, 7)
+	assert.Equal(uint64(2), opts.LogStart)
+	assert.Equal(uint64(7), opts.LogSize)
+}
+
+func TestOpenImageReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "disk.img")
+	d, err := disk.NewFileDisk(path, 1000)
+	assert.NoError(err)
+	log := wal.Open(d)
+	log.Write([]wal.Update{{Addr: 600, Block: mkBlock(1)}})
+	log.Close()
+	d.Close()
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(os.Chtimes(path, mtime, mtime))
+	assert.NoError(os.Chmod(path, 0444))
+
+	img, err := openImage(path)
+	assert.NoError(err)
+	assert.Equal(uint64(1000), img.Size())
+	state, err := wal.Inspect(img, wal.DefaultOptions(img))
+	assert.NoError(err)
+	assert.Len(mkReport(state, img).Entries, 1)
+	assert.Panics(func() { img.Write(600, mkBlock(2)) })
+	img.Close()
+
+	info, err := os.Stat(path)
+	assert.NoError(err)
+	assert.True(info.ModTime().Equal(mtime), "inspecting should not touch the image")
+	assert.Equal(int64(1000*disk.BlockSize), info.Size())
+}
@@ -2,7 +2,9 @@ package dir
 
 import (
 	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
 	"github.com/mit-pdos/perennial-examples/inode"
+	"github.com/mit-pdos/perennial-examples/storage"
 	"github.com/tchajed/goose/machine/disk"
 )
 
@@ -11,18 +13,18 @@ const NumInodes uint64 = 5
 type Dir struct {
 	d         disk.Disk
 	allocator *alloc.Allocator
-	inodes    []*inode.Inode
+	inodes    []storage.Inode
 }
 
-func openInodes(d disk.Disk) []*inode.Inode {
-	var inodes []*inode.Inode
+func openInodes(open func(addr uint64) storage.Inode) []storage.Inode {
+	var inodes []storage.Inode
 	for addr := uint64(0); addr < NumInodes; addr++ {
-		inodes = append(inodes, inode.Open(d, addr))
+		inodes = append(inodes, open(addr))
 	}
 	return inodes
 }
 
-func inodeUsedBlocks(inodes []*inode.Inode) alloc.AddrSet {
+func inodeUsedBlocks(inodes []storage.Inode) alloc.AddrSet {
 	used := make(alloc.AddrSet)
 	for _, i := range inodes {
 		alloc.SetAdd(used, i.UsedBlocks())
@@ -31,7 +33,15 @@ func inodeUsedBlocks(inodes []*inode.Inode) alloc.AddrSet {
 }
 
 func Open(d disk.Disk, sz uint64) *Dir {
-	inodes := openInodes(d)
+	return OpenWith(d, sz, func(addr uint64) storage.Inode {
+		return inode.Open(d, addr)
+	})
+}
+
+// OpenWith is like Open, but uses open to open the inode stored at each
+// address, so the directory can be built over any inode variant.
+func OpenWith(d disk.Disk, sz uint64, open func(addr uint64) storage.Inode) *Dir {
+	inodes := openInodes(open)
 	used := inodeUsedBlocks(inodes)
 	allocator := alloc.New(NumInodes, sz-NumInodes, used)
 	return &Dir{
@@ -51,7 +61,34 @@ func (d *Dir) Size(ino uint64) uint64 {
 	return i.Size()
 }
 
+// AppendErr adds a block to inode ino.
+//
+// Returns errs.ErrInvalidInode if ino >= NumInodes, and otherwise fails like
+// the inode's AppendErr.
+func (d *Dir) AppendErr(ino uint64, b disk.Block) error {
+	if ino >= NumInodes {
+		return errs.ErrInvalidInode
+	}
+	i := d.inodes[ino]
+	return i.AppendErr(b, d.allocator)
+}
+
 func (d *Dir) Append(ino uint64, b disk.Block) bool {
+	return d.AppendErr(ino, b) == nil
+}
+
+// FlushErr makes all blocks appended to inode ino durable.
+//
+// Returns errs.ErrInvalidInode if ino >= NumInodes, and otherwise fails like
+// the inode's FlushErr.
+func (d *Dir) FlushErr(ino uint64) error {
+	if ino >= NumInodes {
+		return errs.ErrInvalidInode
+	}
 	i := d.inodes[ino]
-	return i.Append(b, d.allocator)
+	return i.FlushErr(d.allocator)
+}
+
+func (d *Dir) Flush(ino uint64) bool {
+	return d.FlushErr(ino) == nil
 }
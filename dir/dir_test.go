@@ -5,6 +5,10 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/async_inode"
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
 )
 
 func makeBlock(x byte) disk.Block {
@@ -54,4 +58,34 @@ func TestDirRecoverFull(t *testing.T) {
 	dir = Open(theDisk, theDisk.Size())
 	ok := dir.Append(2, makeBlock(3))
 	assert.False(ok, "should be no space to add more blocks")
+	assert.Equal(errs.ErrNoSpace, dir.AppendErr(2, makeBlock(3)))
+}
+
+func TestDirAppendInvalid(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(NumInodes + 2)
+	dir := Open(theDisk, theDisk.Size())
+	assert.Equal(errs.ErrInvalidInode, dir.AppendErr(NumInodes, makeBlock(1)))
+	assert.False(dir.Append(NumInodes, makeBlock(1)))
+}
+
+func TestDirAsyncInode(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(NumInodes + 100)
+	openAsync := func(addr uint64) storage.Inode {
+		return async_inode.Open(theDisk, addr)
+	}
+	dir := OpenWith(theDisk, theDisk.Size(), openAsync)
+	dir.Append(1, makeBlock(1))
+	dir.Append(1, makeBlock(2))
+	assert.Equal(makeBlock(2), dir.Read(1, 1))
+	assert.True(dir.Flush(1))
+	dir.Append(1, makeBlock(3))
+	assert.Equal(uint64(3), dir.Size(1))
+	assert.Equal(errs.ErrInvalidInode, dir.FlushErr(NumInodes))
+
+	// the unflushed append is lost on crash
+	dir = OpenWith(theDisk, theDisk.Size(), openAsync)
+	assert.Equal(uint64(2), dir.Size(1))
+	assert.Equal(makeBlock(2), dir.Read(1, 1))
 }
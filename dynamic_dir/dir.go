@@ -1,62 +1,50 @@
 package dynamic_dir
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
 	"github.com/mit-pdos/perennial-examples/inode"
+	"github.com/mit-pdos/perennial-examples/storage"
 	"github.com/tchajed/goose/machine/disk"
-	"github.com/tchajed/marshal"
 )
 
-// MaxInodes = 512 (the number of inode addresses that fit into a single root
-// inode)
-const MaxInodes uint64 = disk.BlockSize / 8
-
 const rootInode uint64 = 0
 
-type Dir struct {
-	d         disk.Disk
-	allocator *alloc.Allocator
-
-	m      *sync.Mutex
-	inodes map[uint64]*inode.Inode
+// Ino is a handle to an inode in a Dir.
+type Ino struct {
+	Addr uint64 // address of the inode's header
+	Gen  uint64 // generation number, unique to this inode
 }
 
-func (d *Dir) mkHdr() disk.Block {
-	var inode_addrs []uint64
-	for a, _ := range d.inodes {
-		inode_addrs = append(inode_addrs, a)
-	}
-	enc := marshal.NewEnc(disk.BlockSize)
-	enc.PutInt(uint64(len(inode_addrs)))
-	enc.PutInts(inode_addrs)
-	return enc.Finish()
-}
-
-func (d *Dir) writeHdr() {
-	hdr := d.mkHdr()
-	d.d.Write(rootInode, hdr)
+// DirEntry is a named inode, as listed by ReadDir.
+type DirEntry struct {
+	Name string
+	Ino  Ino
 }
 
-// read header (which has addresses for inodes in use)
-func parseHdr(b disk.Block) []uint64 {
-	dec := marshal.NewDec(b)
-	num := dec.GetInt()
-	return dec.GetInts(num)
-}
+type Dir struct {
+	d         disk.Disk
+	allocator *alloc.Allocator
+	maxTable  uint64 // maximum number of table blocks
+	open      func(addr uint64) storage.Inode
 
-func openInodes(d disk.Disk) map[uint64]*inode.Inode {
-	inode_addrs := parseHdr(d.Read(rootInode))
-	inodes := make(map[uint64]*inode.Inode)
-	for _, a := range inode_addrs {
-		inodes[a] = inode.Open(d, a)
-	}
-	return inodes
+	m       *sync.Mutex
+	inodes  map[uint64]storage.Inode
+	gens    map[uint64]uint64 // generation of each inode in inodes
+	names   map[string]uint64 // address of the inode with each name
+	nextGen uint64
+	table   []*tableBlock
+	tableOf map[uint64]*tableBlock // table block holding each inode
 }
 
-func inodeUsedBlocks(inodes map[uint64]*inode.Inode) alloc.AddrSet {
+func inodeUsedBlocks(table []*tableBlock, inodes map[uint64]storage.Inode) alloc.AddrSet {
 	used := make(alloc.AddrSet)
+	for _, tb := range table {
+		alloc.SetAdd(used, []uint64{tb.addr})
+	}
 	for a, i := range inodes {
 		alloc.SetAdd(used, []uint64{a})
 		alloc.SetAdd(used, i.UsedBlocks())
@@ -65,80 +53,281 @@ func inodeUsedBlocks(inodes map[uint64]*inode.Inode) alloc.AddrSet {
 }
 
 func Open(d disk.Disk, sz uint64) *Dir {
-	inodes := openInodes(d)
-	used := inodeUsedBlocks(inodes)
-	// reserve 1 block for root inode
-	allocator := alloc.New(1, sz-1, used)
-	return &Dir{
+	return OpenWith(d, sz, func(addr uint64) storage.Inode {
+		return inode.Open(d, addr)
+	})
+}
+
+// OpenWith is like Open, but uses open to open the inode stored at each
+// address, so the directory can be built over any inode variant. An inode
+// whose header block is all zeros must be empty.
+func OpenWith(d disk.Disk, sz uint64, open func(addr uint64) storage.Inode) *Dir {
+	nextGen, table := readTable(d)
+	dir := &Dir{
 		d:         d,
-		allocator: allocator,
+		allocator: nil,
+		maxTable:  maxTableBlocks,
+		open:      open,
 		m:         new(sync.Mutex),
-		inodes:    inodes,
+		inodes:    make(map[uint64]storage.Inode),
+		gens:      make(map[uint64]uint64),
+		names:     make(map[string]uint64),
+		nextGen:   nextGen,
+		table:     table,
+		tableOf:   make(map[uint64]*tableBlock),
 	}
+	for _, tb := range table {
+		for _, e := range tb.entries {
+			dir.inodes[e.ino.Addr] = open(e.ino.Addr)
+			dir.gens[e.ino.Addr] = e.ino.Gen
+			dir.names[e.name] = e.ino.Addr
+			dir.tableOf[e.ino.Addr] = tb
+		}
+	}
+	used := inodeUsedBlocks(table, dir.inodes)
+	// reserve 1 block for root inode
+	dir.allocator = alloc.New(1, sz-1, used)
+	return dir
 }
 
-func (d *Dir) Create() (uint64, bool) {
+func validName(name string) bool {
+	return uint64(len(name)) > 0 && uint64(len(name)) <= MaxNameLen
+}
+
+// get returns the inode for ino, or nil if ino does not refer to a current
+// inode (including if it is a stale handle to a deleted inode)
+//
+// Requires the lock to be held.
+func (d *Dir) get(ino Ino) storage.Inode {
+	i := d.inodes[ino.Addr]
+	if i == nil || d.gens[ino.Addr] != ino.Gen {
+		return nil
+	}
+	return i
+}
+
+// CreateErr allocates a new, empty inode called name and returns a handle to
+// it.
+//
+// Returns errs.ErrInvalidName if name is empty or longer than MaxNameLen,
+// errs.ErrExists if name is already in use, errs.ErrNoSpace if there is no
+// free block for the inode (or for a new table block), or errs.ErrDirFull if
+// the table has no room for another entry.
+func (d *Dir) CreateErr(name string) (Ino, error) {
+	if !validName(name) {
+		return Ino{}, errs.ErrInvalidName
+	}
 	a, ok := d.allocator.Reserve()
 	if !ok {
-		return 0, false
+		return Ino{}, errs.ErrNoSpace
 	}
 	empty := make(disk.Block, disk.BlockSize)
 	d.d.Write(a, empty)
 	d.m.Lock()
-	d.inodes[a] = inode.Open(d.d, a)
-	d.writeHdr()
+	_, exists := d.names[name]
+	if exists {
+		d.m.Unlock()
+		d.allocator.Free(a)
+		return Ino{}, errs.ErrExists
+	}
+	ino := Ino{Addr: a, Gen: d.nextGen}
+	d.nextGen = d.nextGen + 1
+	err := d.insert(entry{name: name, ino: ino})
+	if err != nil {
+		d.m.Unlock()
+		d.allocator.Free(a)
+		return Ino{}, err
+	}
+	d.inodes[a] = d.open(a)
+	d.gens[a] = ino.Gen
+	d.names[name] = a
 	d.m.Unlock()
-	return a, true
+	return ino, nil
+}
+
+func (d *Dir) Create(name string) (Ino, bool) {
+	ino, err := d.CreateErr(name)
+	return ino, err == nil
 }
 
-func (d *Dir) delete(ino uint64) {
-	i := d.inodes[ino]
-	delete(d.inodes, ino)
-	d.writeHdr() // crash commit point
+// Lookup returns the inode called name.
+//
+// Returns errs.ErrNotFound if there is no such inode.
+func (d *Dir) Lookup(name string) (Ino, error) {
+	d.m.Lock()
+	a, ok := d.names[name]
+	if !ok {
+		d.m.Unlock()
+		return Ino{}, errs.ErrNotFound
+	}
+	ino := Ino{Addr: a, Gen: d.gens[a]}
+	d.m.Unlock()
+	return ino, nil
+}
+
+// ReadDir lists every inode in the directory, sorted by name.
+func (d *Dir) ReadDir() []DirEntry {
+	d.m.Lock()
+	var ents []DirEntry
+	for name, a := range d.names {
+		ents = append(ents, DirEntry{Name: name, Ino: Ino{Addr: a, Gen: d.gens[a]}})
+	}
+	d.m.Unlock()
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name < ents[j].Name })
+	return ents
+}
+
+// Rename atomically changes the name of the inode called oldName to newName.
+//
+// Returns errs.ErrNotFound if there is no inode called oldName,
+// errs.ErrInvalidName if newName is not a valid name, or errs.ErrExists if
+// newName is already in use (Rename does not replace existing entries). The
+// directory is unchanged if Rename fails.
+func (d *Dir) Rename(oldName string, newName string) error {
+	if !validName(newName) {
+		return errs.ErrInvalidName
+	}
+	d.m.Lock()
+	a, ok := d.names[oldName]
+	if !ok {
+		d.m.Unlock()
+		return errs.ErrNotFound
+	}
+	if oldName == newName {
+		d.m.Unlock()
+		return nil
+	}
+	_, exists := d.names[newName]
+	if exists {
+		d.m.Unlock()
+		return errs.ErrExists
+	}
+	err := d.rename(a, newName)
+	if err != nil {
+		d.m.Unlock()
+		return err
+	}
+	delete(d.names, oldName)
+	d.names[newName] = a
+	d.m.Unlock()
+	return nil
+}
+
+// delete removes the inode at address a from the directory
+//
+// Requires the lock to be held and a to be in use.
+func (d *Dir) delete(a uint64) {
+	i := d.inodes[a]
+	name := d.tableOf[a].find(a).name
+	delete(d.inodes, a)
+	delete(d.gens, a)
+	delete(d.names, name)
+	d.remove(a) // crash commit point
 	// now we can free all the used addresses for other threads to use
 	// (somewhat optional - restarting the system would also free these
 	// addresses)
-	d.allocator.Free(ino)
+	d.allocator.Free(a)
 	for _, inode_a := range i.UsedBlocks() {
 		d.allocator.Free(inode_a)
 	}
 }
 
-func (d *Dir) Delete(ino uint64) {
+// Delete removes inode ino and frees its blocks.
+//
+// Returns errs.ErrInvalidInode, without changing anything, if ino has not been
+// created or was already deleted.
+func (d *Dir) Delete(ino Ino) error {
 	d.m.Lock()
-	d.delete(ino)
+	if d.get(ino) == nil {
+		d.m.Unlock()
+		return errs.ErrInvalidInode
+	}
+	d.delete(ino.Addr)
 	d.m.Unlock()
+	return nil
 }
 
-func (d *Dir) Read(ino uint64, off uint64) disk.Block {
+// Unlink deletes the inode called name and frees its blocks.
+//
+// Returns errs.ErrNotFound if there is no such inode.
+func (d *Dir) Unlink(name string) error {
 	d.m.Lock()
-	i := d.inodes[ino]
+	a, ok := d.names[name]
+	if !ok {
+		d.m.Unlock()
+		return errs.ErrNotFound
+	}
+	d.delete(a)
+	d.m.Unlock()
+	return nil
+}
+
+// Read returns block off of inode ino (nil if off is past the end).
+//
+// Returns errs.ErrInvalidInode if ino has not been created or was deleted.
+func (d *Dir) Read(ino Ino, off uint64) (disk.Block, error) {
+	d.m.Lock()
+	i := d.get(ino)
 	if i == nil {
-		panic("invalid inode")
+		d.m.Unlock()
+		return nil, errs.ErrInvalidInode
 	}
 	b := i.Read(off)
 	d.m.Unlock()
-	return b
+	return b, nil
 }
 
-func (d *Dir) Size(ino uint64) uint64 {
+// Size returns the number of blocks in inode ino.
+//
+// Returns errs.ErrInvalidInode if ino has not been created or was deleted.
+func (d *Dir) Size(ino Ino) (uint64, error) {
 	d.m.Lock()
-	i := d.inodes[ino]
+	i := d.get(ino)
 	if i == nil {
-		panic("invalid inode")
+		d.m.Unlock()
+		return 0, errs.ErrInvalidInode
 	}
 	sz := i.Size()
 	d.m.Unlock()
-	return sz
+	return sz, nil
+}
+
+// AppendErr adds a block to inode ino.
+//
+// Returns errs.ErrInvalidInode if ino has not been created (or has been
+// deleted), and otherwise fails like the inode's AppendErr.
+func (d *Dir) AppendErr(ino Ino, b disk.Block) error {
+	d.m.Lock()
+	i := d.get(ino)
+	if i == nil {
+		d.m.Unlock()
+		return errs.ErrInvalidInode
+	}
+	err := i.AppendErr(b, d.allocator)
+	d.m.Unlock()
+	return err
 }
 
-func (d *Dir) Append(ino uint64, b disk.Block) bool {
+func (d *Dir) Append(ino Ino, b disk.Block) bool {
+	return d.AppendErr(ino, b) == nil
+}
+
+// FlushErr makes all blocks appended to inode ino durable.
+//
+// Returns errs.ErrInvalidInode if ino has not been created (or has been
+// deleted), and otherwise fails like the inode's FlushErr.
+func (d *Dir) FlushErr(ino Ino) error {
 	d.m.Lock()
-	i := d.inodes[ino]
+	i := d.get(ino)
 	if i == nil {
-		panic("invalid inode")
+		d.m.Unlock()
+		return errs.ErrInvalidInode
 	}
-	ok := i.Append(b, d.allocator)
+	err := i.FlushErr(d.allocator)
 	d.m.Unlock()
-	return ok
+	return err
+}
+
+func (d *Dir) Flush(ino Ino) bool {
+	return d.FlushErr(ino) == nil
 }
@@ -1,10 +1,16 @@
 package dynamic_dir
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/errs"
+	indirect_inode "github.com/mit-pdos/perennial-examples/indirect_inode"
+	"github.com/mit-pdos/perennial-examples/storage"
 )
 
 func makeBlock(x byte) disk.Block {
@@ -13,76 +19,290 @@ func makeBlock(x byte) disk.Block {
 	return b
 }
 
+func mustRead(t *testing.T, dir *Dir, ino Ino, off uint64) disk.Block {
+	b, err := dir.Read(ino, off)
+	assert.NoError(t, err)
+	return b
+}
+
+func mustSize(t *testing.T, dir *Dir, ino Ino) uint64 {
+	sz, err := dir.Size(ino)
+	assert.NoError(t, err)
+	return sz
+}
+
 func TestDirAppendRead(t *testing.T) {
 	assert := assert.New(t)
-	theDisk := disk.NewMemDisk(MaxInodes + 100)
+	theDisk := disk.NewMemDisk(1000)
 	dir := Open(theDisk, theDisk.Size())
-	ino0, ok := dir.Create()
+	ino0, ok := dir.Create("ino0")
 	assert.True(ok, "creating inode should succeed")
-	ino1, _ := dir.Create()
-	assert.Equal(uint64(0), dir.Size(ino1))
+	ino1, _ := dir.Create("ino1")
+	assert.Equal(uint64(0), mustSize(t, dir, ino1))
 	dir.Append(ino1, makeBlock(1))
-	ino2, _ := dir.Create()
+	ino2, _ := dir.Create("ino2")
 	dir.Append(ino1, makeBlock(2))
 	dir.Append(ino2, makeBlock(3))
-	assert.Equal(uint64(2), dir.Size(ino1))
-	assert.Equal(makeBlock(2), dir.Read(ino1, 1))
-	assert.Equal(makeBlock(3), dir.Read(ino2, 0))
-	assert.Equal(uint64(0), dir.Size(ino0))
+	assert.Equal(uint64(2), mustSize(t, dir, ino1))
+	assert.Equal(makeBlock(2), mustRead(t, dir, ino1, 1))
+	assert.Equal(makeBlock(3), mustRead(t, dir, ino2, 0))
+	assert.Equal(uint64(0), mustSize(t, dir, ino0))
 }
 
 func TestDirCreateDelete(t *testing.T) {
 	assert := assert.New(t)
-	theDisk := disk.NewMemDisk(MaxInodes + 100)
+	theDisk := disk.NewMemDisk(1000)
 	dir := Open(theDisk, theDisk.Size())
-	ino0, _ := dir.Create()
-	ino1, _ := dir.Create()
-	assert.Equal(uint64(0), dir.Size(ino1))
+	ino0, _ := dir.Create("ino0")
+	ino1, _ := dir.Create("ino1")
+	assert.Equal(uint64(0), mustSize(t, dir, ino1))
 	dir.Append(ino1, makeBlock(1))
-	ino2, _ := dir.Create()
+	ino2, _ := dir.Create("ino2")
 	dir.Append(ino1, makeBlock(2))
 	dir.Append(ino2, makeBlock(3))
-	assert.Equal(uint64(2), dir.Size(ino1))
-	assert.Equal(makeBlock(2), dir.Read(ino1, 1))
+	assert.Equal(uint64(2), mustSize(t, dir, ino1))
+	assert.Equal(makeBlock(2), mustRead(t, dir, ino1, 1))
 	dir.Delete(ino1)
-	assert.Equal(makeBlock(3), dir.Read(ino2, 0))
+	assert.Equal(makeBlock(3), mustRead(t, dir, ino2, 0))
 	dir.Delete(ino2)
-	assert.Equal(uint64(0), dir.Size(ino0))
-	ino3, _ := dir.Create()
+	assert.Equal(uint64(0), mustSize(t, dir, ino0))
+	ino3, _ := dir.Create("ino3")
 	dir.Append(ino3, makeBlock(1))
-	assert.Equal(makeBlock(1), dir.Read(ino3, 0))
+	assert.Equal(makeBlock(1), mustRead(t, dir, ino3, 0))
 }
 
 func TestDirRecover(t *testing.T) {
 	assert := assert.New(t)
-	theDisk := disk.NewMemDisk(MaxInodes + 3)
+	theDisk := disk.NewMemDisk(1000)
 	dir := Open(theDisk, theDisk.Size())
-	ino1, _ := dir.Create()
+	ino1, _ := dir.Create("ino1")
 	ok := dir.Append(ino1, makeBlock(1))
 	assert.True(ok, "append should succeed")
 	assert.True(dir.Append(ino1, makeBlock(2)),
 		"append should succeed")
 
 	dir = Open(theDisk, theDisk.Size())
-	ino2, ok := dir.Create()
+	ino2, ok := dir.Create("ino2")
 	assert.True(ok, "create should succeed")
 	assert.True(dir.Append(ino2, makeBlock(3)),
 		"append of last block should succeed")
-	assert.Equal(makeBlock(1), dir.Read(ino1, 0))
-	assert.Equal(makeBlock(2), dir.Read(ino1, 1))
-	assert.Equal(makeBlock(3), dir.Read(ino2, 0))
+	assert.Equal(makeBlock(1), mustRead(t, dir, ino1, 0))
+	assert.Equal(makeBlock(2), mustRead(t, dir, ino1, 1))
+	assert.Equal(makeBlock(3), mustRead(t, dir, ino2, 0))
 }
 
 func TestDirRecoverFull(t *testing.T) {
 	assert := assert.New(t)
-	theDisk := disk.NewMemDisk(1 + 2 + 2)
+	// root, table block, 2 inodes, 2 data blocks
+	theDisk := disk.NewMemDisk(1 + 1 + 2 + 2)
 	dir := Open(theDisk, theDisk.Size())
-	ino1, _ := dir.Create()
-	ino2, _ := dir.Create()
+	ino1, _ := dir.Create("ino1")
+	ino2, _ := dir.Create("ino2")
 	dir.Append(ino1, makeBlock(1))
 	dir.Append(ino1, makeBlock(2))
 
 	dir = Open(theDisk, theDisk.Size())
 	ok := dir.Append(ino2, makeBlock(3))
 	assert.False(ok, "should be no space to add more blocks")
+	assert.Equal(errs.ErrNoSpace, dir.AppendErr(ino2, makeBlock(3)))
+	_, err := dir.CreateErr("ino3")
+	assert.Equal(errs.ErrNoSpace, err)
+}
+
+func TestDirInvalidInode(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1000)
+	dir := Open(theDisk, theDisk.Size())
+	ino, _ := dir.Create("ino")
+	assert.NoError(dir.Delete(ino))
+
+	_, err := dir.Read(ino, 0)
+	assert.Equal(errs.ErrInvalidInode, err)
+	_, err = dir.Size(ino)
+	assert.Equal(errs.ErrInvalidInode, err)
+	assert.Equal(errs.ErrInvalidInode, dir.AppendErr(ino, makeBlock(1)))
+	assert.False(dir.Append(ino, makeBlock(1)))
+	assert.Equal(errs.ErrInvalidInode, dir.Delete(ino),
+		"deleting twice should be reported")
+	assert.Equal(errs.ErrInvalidInode, dir.Delete(Ino{Addr: 12345}))
+
+	// the failed operations should not have disturbed the directory
+	ino2, ok := dir.Create("ino2")
+	assert.True(ok)
+	assert.True(dir.Append(ino2, makeBlock(2)))
+	assert.Equal(makeBlock(2), mustRead(t, dir, ino2, 0))
+}
+
+func TestDirStaleHandle(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1 + 1 + 2)
+	dir := Open(theDisk, theDisk.Size())
+	ino1, _ := dir.Create("ino1")
+	filler, _ := dir.Create("filler")
+	dir.Delete(ino1)
+	ino2, ok := dir.Create("ino2")
+	assert.True(ok)
+	assert.Equal(ino1.Addr, ino2.Addr, "only one address to allocate")
+	// make space for a data block
+	dir.Delete(filler)
+	assert.NotEqual(ino1.Gen, ino2.Gen)
+	assert.True(dir.Append(ino2, makeBlock(2)))
+
+	_, err := dir.Read(ino1, 0)
+	assert.Equal(errs.ErrInvalidInode, err, "stale handle should not read new inode")
+	assert.Equal(errs.ErrInvalidInode, dir.AppendErr(ino1, makeBlock(1)))
+	assert.Equal(errs.ErrInvalidInode, dir.Delete(ino1))
+
+	// generations are durable
+	dir = Open(theDisk, theDisk.Size())
+	_, err = dir.Size(ino1)
+	assert.Equal(errs.ErrInvalidInode, err)
+	assert.Equal(makeBlock(2), mustRead(t, dir, ino2, 0))
+	dir.Delete(ino2)
+	ino3, _ := dir.Create("ino3")
+	assert.NotEqual(ino2.Gen, ino3.Gen,
+		"generations should not be reused after recovery")
+}
+
+func TestDirManyInodes(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(2000)
+	dir := Open(theDisk, theDisk.Size())
+	var inos []Ino
+	for i := 0; i < 600; i++ {
+		ino, ok := dir.Create(fmt.Sprintf("file%d", i))
+		assert.True(ok, "create should succeed")
+		assert.True(dir.Append(ino, makeBlock(byte(i))))
+		inos = append(inos, ino)
+	}
+	assert.True(len(dir.table) > 1, "inodes should span several table blocks")
+
+	dir = Open(theDisk, theDisk.Size())
+	for i, ino := range inos {
+		assert.Equal(makeBlock(byte(i)), mustRead(t, dir, ino, 0))
+	}
+	for _, ino := range inos {
+		assert.NoError(dir.Delete(ino))
+	}
+	assert.Len(dir.table, 0, "empty table blocks should be dropped")
+
+	dir = Open(theDisk, theDisk.Size())
+	assert.Len(dir.inodes, 0)
+	var numFree uint64 = 0
+	for {
+		_, ok := dir.allocator.Reserve()
+		if !ok {
+			break
+		}
+		numFree++
+	}
+	assert.Equal(theDisk.Size()-1, numFree, "every block should be free again")
+}
+
+func TestDirFull(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1000)
+	dir := Open(theDisk, theDisk.Size())
+	dir.maxTable = 1
+	var n uint64 = 0
+	for {
+		_, err := dir.CreateErr(fmt.Sprintf("file%d", n))
+		if err != nil {
+			assert.Equal(errs.ErrDirFull, err)
+			break
+		}
+		n++
+	}
+	assert.True(n >= minTableEntries, "table block should hold at least minTableEntries")
+
+	dir.Unlink("file0")
+	_, err := dir.CreateErr("file0")
+	assert.NoError(err, "deleting should make room")
+}
+
+func TestDirNames(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1000)
+	dir := Open(theDisk, theDisk.Size())
+	a, _ := dir.Create("a")
+	b, _ := dir.Create("b")
+	_, err := dir.CreateErr("a")
+	assert.Equal(errs.ErrExists, err, "duplicate names should be rejected")
+	_, err = dir.CreateErr("")
+	assert.Equal(errs.ErrInvalidName, err)
+	_, err = dir.CreateErr(strings.Repeat("x", int(MaxNameLen)+1))
+	assert.Equal(errs.ErrInvalidName, err)
+
+	ino, err := dir.Lookup("b")
+	assert.NoError(err)
+	assert.Equal(b, ino)
+	_, err = dir.Lookup("c")
+	assert.Equal(errs.ErrNotFound, err)
+
+	assert.Equal(errs.ErrExists, dir.Rename("a", "b"),
+		"rename should not replace an existing entry")
+	assert.Equal(errs.ErrNotFound, dir.Rename("c", "d"))
+	assert.NoError(dir.Rename("a", "c"))
+	assert.Equal([]DirEntry{{Name: "b", Ino: b}, {Name: "c", Ino: a}}, dir.ReadDir())
+
+	dir = Open(theDisk, theDisk.Size())
+	assert.Equal([]DirEntry{{Name: "b", Ino: b}, {Name: "c", Ino: a}}, dir.ReadDir())
+	assert.Equal(errs.ErrNotFound, dir.Unlink("a"))
+	assert.NoError(dir.Unlink("c"))
+	assert.Equal([]DirEntry{{Name: "b", Ino: b}}, dir.ReadDir())
+	_, err = dir.Read(a, 0)
+	assert.Equal(errs.ErrInvalidInode, err)
+}
+
+func TestDirRenameMove(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1000)
+	dir := Open(theDisk, theDisk.Size())
+	// fill up the first table block with short names
+	var n uint64 = 0
+	for len(dir.table) == 1 || n == 0 {
+		dir.Create(fmt.Sprintf("%d", n))
+		n++
+	}
+	ino, _ := dir.Lookup("0")
+	dir.Append(ino, makeBlock(7))
+	long := strings.Repeat("x", int(MaxNameLen))
+	assert.NoError(dir.Rename("0", long))
+	assert.Equal(dir.table[1], dir.tableOf[ino.Addr],
+		"longer name should move to the table block with space")
+
+	dir = Open(theDisk, theDisk.Size())
+	_, err := dir.Lookup("0")
+	assert.Equal(errs.ErrNotFound, err)
+	ino2, err := dir.Lookup(long)
+	assert.NoError(err)
+	assert.Equal(ino, ino2)
+	assert.Equal(makeBlock(7), mustRead(t, dir, ino, 0))
+	assert.Len(dir.ReadDir(), int(n))
+}
+
+func TestDirIndirectInode(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1000)
+	openIndirect := func(addr uint64) storage.Inode {
+		return indirect_inode.Open(theDisk, addr)
+	}
+	dir := OpenWith(theDisk, theDisk.Size(), openIndirect)
+	ino, _ := dir.Create("big")
+	// use some indirect blocks
+	for i := 0; i < 600; i++ {
+		assert.NoError(dir.AppendErr(ino, makeBlock(byte(i))))
+	}
+	assert.NoError(dir.FlushErr(ino))
+
+	dir = OpenWith(theDisk, theDisk.Size(), openIndirect)
+	assert.Equal(uint64(600), mustSize(t, dir, ino))
+	assert.Equal(makeBlock(byte(599%256)), mustRead(t, dir, ino, 599))
+	// recovery should account for the indirect blocks
+	ino2, _ := dir.Create("other")
+	for i := 0; i < 300; i++ {
+		assert.NoError(dir.AppendErr(ino2, makeBlock(1)))
+	}
+	assert.Equal(makeBlock(byte(599%256)), mustRead(t, dir, ino, 599))
+	assert.NoError(dir.Delete(ino))
 }
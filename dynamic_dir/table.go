@@ -0,0 +1,286 @@
+package dynamic_dir
+
+import (
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/perennial-examples/errs"
+)
+
+// on-disk layout of the inode table:
+//
+// root (block 0):
+// [ nextGen: u64 | numTable: u64 | table: [numTable]u64 ]
+//
+// table block:
+// [ num: u64 |
+//   entries: [num]{ addr: u64 | gen: u64 | nameLen: u64 | name: [nameLen]byte } ]
+//
+// Every change to the table commits with a single block write. Adding,
+// removing or renaming an entry overwrites the one table block that holds it,
+// except that a new table block is written in full before the root points to
+// it, and a table block that becomes empty is dropped by rewriting the root.
+// Moving an entry between table blocks (when a longer name no longer fits)
+// writes shadow copies of both blocks and then switches to them with one root
+// write.
+//
+// Every inode is created with a fresh generation number, so a handle to a
+// deleted inode does not refer to a new inode that reuses its address. nextGen
+// is persisted before any inode that uses it.
+
+// MaxNameLen is the maximum length of a name, in bytes.
+const MaxNameLen uint64 = 64
+
+// size of an entry without its name
+const entryHdrSize uint64 = 3 * 8
+
+// maxTableBlocks = 510 (the number of table addresses that fit in the root)
+const maxTableBlocks uint64 = disk.BlockSize/8 - 2
+
+// minTableEntries = 46 (the number of entries that fit in a table block even
+// if every name is MaxNameLen bytes)
+const minTableEntries uint64 = (disk.BlockSize - 8) / (entryHdrSize + MaxNameLen)
+
+// MaxInodes = 23460 (the number of inodes the table is guaranteed to hold;
+// more fit if names are short)
+const MaxInodes uint64 = maxTableBlocks * minTableEntries
+
+type entry struct {
+	name string
+	ino  Ino
+}
+
+func entrySize(name string) uint64 {
+	return entryHdrSize + uint64(len(name))
+}
+
+type tableBlock struct {
+	addr    uint64
+	entries []entry
+}
+
+// used returns the number of bytes tb takes up on disk
+func (tb *tableBlock) used() uint64 {
+	var sz uint64 = 8
+	for _, e := range tb.entries {
+		sz = sz + entrySize(e.name)
+	}
+	return sz
+}
+
+func (tb *tableBlock) hasSpace(name string) bool {
+	return tb.used()+entrySize(name) <= disk.BlockSize
+}
+
+func (tb *tableBlock) mkBlock() disk.Block {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(uint64(len(tb.entries)))
+	for _, e := range tb.entries {
+		enc.PutInt(e.ino.Addr)
+		enc.PutInt(e.ino.Gen)
+		enc.PutInt(uint64(len(e.name)))
+		enc.PutBytes([]byte(e.name))
+	}
+	return enc.Finish()
+}
+
+func parseTableBlock(a uint64, b disk.Block) *tableBlock {
+	dec := marshal.NewDec(b)
+	num := dec.GetInt()
+	var entries []entry
+	for i := uint64(0); i < num; i++ {
+		addr := dec.GetInt()
+		gen := dec.GetInt()
+		nameLen := dec.GetInt()
+		name := string(dec.GetBytes(nameLen))
+		entries = append(entries, entry{name: name, ino: Ino{Addr: addr, Gen: gen}})
+	}
+	return &tableBlock{addr: a, entries: entries}
+}
+
+// find returns the entry for the inode at address a
+//
+// Requires a to be in tb.
+func (tb *tableBlock) find(a uint64) entry {
+	var found entry
+	for _, e := range tb.entries {
+		if e.ino.Addr == a {
+			found = e
+		}
+	}
+	return found
+}
+
+// remove deletes the entry for the inode at address a from tb (in memory)
+func (tb *tableBlock) remove(a uint64) {
+	var entries []entry
+	for _, e := range tb.entries {
+		if e.ino.Addr != a {
+			entries = append(entries, e)
+		}
+	}
+	tb.entries = entries
+}
+
+// setName renames the entry for the inode at address a (in memory)
+func (tb *tableBlock) setName(a uint64, name string) {
+	for i, e := range tb.entries {
+		if e.ino.Addr == a {
+			tb.entries[i].name = name
+		}
+	}
+}
+
+func (d *Dir) mkRoot() disk.Block {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(d.nextGen)
+	enc.PutInt(uint64(len(d.table)))
+	for _, tb := range d.table {
+		enc.PutInt(tb.addr)
+	}
+	return enc.Finish()
+}
+
+func (d *Dir) writeRoot() {
+	d.d.Write(rootInode, d.mkRoot())
+}
+
+// readTable reads the root and every table block
+//
+// Returns the next generation number and the table blocks.
+func readTable(d disk.Disk) (uint64, []*tableBlock) {
+	dec := marshal.NewDec(d.Read(rootInode))
+	nextGen := dec.GetInt()
+	num := dec.GetInt()
+	addrs := dec.GetInts(num)
+	var table []*tableBlock
+	for _, a := range addrs {
+		table = append(table, parseTableBlock(a, d.Read(a)))
+	}
+	return nextGen, table
+}
+
+// findSpace returns a table block with room for an entry called name, or nil
+// if there is none
+//
+// Requires the lock to be held.
+func (d *Dir) findSpace(name string) *tableBlock {
+	var found *tableBlock
+	for _, tb := range d.table {
+		if found == nil && tb.hasSpace(name) {
+			found = tb
+		}
+	}
+	return found
+}
+
+// insert durably adds e to the table
+//
+// Requires the lock to be held and e.ino.Gen < d.nextGen.
+//
+// Returns errs.ErrDirFull if the table cannot grow any further, or
+// errs.ErrNoSpace if a new table block is needed and none can be allocated.
+func (d *Dir) insert(e entry) error {
+	tb := d.findSpace(e.name)
+	if tb != nil {
+		// persist nextGen so e.ino.Gen is never reused
+		d.writeRoot()
+		tb.entries = append(tb.entries, e)
+		d.d.Write(tb.addr, tb.mkBlock()) // crash commit point
+		d.tableOf[e.ino.Addr] = tb
+		return nil
+	}
+	if uint64(len(d.table)) >= d.maxTable {
+		return errs.ErrDirFull
+	}
+	a, ok := d.allocator.Reserve()
+	if !ok {
+		return errs.ErrNoSpace
+	}
+	newTb := &tableBlock{addr: a, entries: []entry{e}}
+	d.d.Write(a, newTb.mkBlock())
+	d.table = append(d.table, newTb)
+	d.writeRoot() // crash commit point
+	d.tableOf[e.ino.Addr] = newTb
+	return nil
+}
+
+// remove durably removes the inode at address a from the table
+//
+// Requires the lock to be held and a to be in the table.
+func (d *Dir) remove(a uint64) {
+	tb := d.tableOf[a]
+	delete(d.tableOf, a)
+	tb.remove(a)
+	if len(tb.entries) > 0 {
+		d.d.Write(tb.addr, tb.mkBlock()) // crash commit point
+		return
+	}
+	// drop the now-empty table block
+	var table []*tableBlock
+	for _, tb2 := range d.table {
+		if tb2 != tb {
+			table = append(table, tb2)
+		}
+	}
+	d.table = table
+	d.writeRoot() // crash commit point
+	d.allocator.Free(tb.addr)
+}
+
+// rename durably changes the name of the inode at address a to name
+//
+// Requires the lock to be held and a to be in the table.
+//
+// Returns errs.ErrDirFull or errs.ErrNoSpace, without changing anything, if
+// the entry has to move to a new table block and cannot.
+func (d *Dir) rename(a uint64, name string) error {
+	src := d.tableOf[a]
+	e := src.find(a)
+	if src.used()-entrySize(e.name)+entrySize(name) <= disk.BlockSize {
+		src.setName(a, name)
+		d.d.Write(src.addr, src.mkBlock()) // crash commit point
+		return nil
+	}
+	// Move the entry to another table block. src does not become empty, since
+	// an entry on its own always fits.
+	dst := d.findSpace(name)
+	if dst == nil && uint64(len(d.table)) >= d.maxTable {
+		return errs.ErrDirFull
+	}
+	srcAddr, ok := d.allocator.Reserve()
+	if !ok {
+		return errs.ErrNoSpace
+	}
+	dstAddr, ok := d.allocator.Reserve()
+	if !ok {
+		d.allocator.Free(srcAddr)
+		return errs.ErrNoSpace
+	}
+
+	oldSrcAddr := src.addr
+	src.remove(a)
+	src.addr = srcAddr
+	d.d.Write(srcAddr, src.mkBlock())
+
+	e.name = name
+	// the root is never a table block, so 0 means there is no old dst block
+	var oldDstAddr uint64 = 0
+	if dst == nil {
+		dst = &tableBlock{addr: dstAddr, entries: []entry{e}}
+		d.table = append(d.table, dst)
+	} else {
+		oldDstAddr = dst.addr
+		dst.entries = append(dst.entries, e)
+		dst.addr = dstAddr
+	}
+	d.d.Write(dstAddr, dst.mkBlock())
+	d.tableOf[a] = dst
+
+	d.writeRoot() // crash commit point
+	d.allocator.Free(oldSrcAddr)
+	if oldDstAddr != 0 {
+		d.allocator.Free(oldDstAddr)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+// Sentinel errors shared by the block-storage packages, so callers can tell
+// failures apart regardless of which allocator, inode or directory they use.
+package errs
+
+import "errors"
+
+var (
+	// ErrNoSpace means the allocator has no free blocks.
+	ErrNoSpace = errors.New("no free blocks")
+	// ErrInodeFull means the inode is already at its maximum size.
+	ErrInodeFull = errors.New("inode is at maximum size")
+	// ErrTxnTooLarge means a transaction can never fit in the log.
+	ErrTxnTooLarge = errors.New("transaction too large")
+	// ErrInvalidOffset means an offset is past the end of an inode.
+	ErrInvalidOffset = errors.New("offset past end of inode")
+	// ErrInvalidInode means the inode number does not refer to an inode.
+	ErrInvalidInode = errors.New("invalid inode")
+	// ErrDirFull means the directory has no room for another inode.
+	ErrDirFull = errors.New("directory is full")
+	// ErrNotFound means there is no directory entry with the given name.
+	ErrNotFound = errors.New("no such entry")
+	// ErrExists means a directory entry with the given name already exists.
+	ErrExists = errors.New("entry already exists")
+	// ErrInvalidName means a name is empty, too long, or otherwise not
+	// allowed.
+	ErrInvalidName = errors.New("invalid name")
+	// ErrNotDir means a path component that should be a directory is not.
+	ErrNotDir = errors.New("not a directory")
+	// ErrIsDir means a file operation was given a directory.
+	ErrIsDir = errors.New("is a directory")
+	// ErrNotEmpty means a directory cannot be removed because it has entries.
+	ErrNotEmpty = errors.New("directory not empty")
+)
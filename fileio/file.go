@@ -0,0 +1,124 @@
+// Adapters from inodes with byte-granularity reads and writes to the standard
+// io interfaces.
+package fileio
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/mit-pdos/perennial-examples/storage"
+)
+
+// ErrNegativeOffset is returned for reads, writes and seeks to a negative
+// offset.
+var ErrNegativeOffset = errors.New("fileio: negative offset")
+
+var errWhence = errors.New("fileio: invalid whence")
+
+// Inode is an inode that supports reads and writes at any byte offset, such
+// as inode.Inode and indirect_inode's Inode.
+//
+// WriteAt must be all-or-nothing: if it returns an error, none of data has
+// been written, which is what lets File report how many bytes it wrote.
+type Inode interface {
+	ByteSize() uint64
+	ReadAt(off uint64, n uint64) []byte
+	WriteAt(off uint64, data []byte, allocator storage.Allocator) error
+}
+
+// File is an open inode, which implements io.ReaderAt, io.WriterAt and
+// io.ReadWriteSeeker.
+//
+// Writes allocate from the allocator the File was created with. Read, Write
+// and Seek share a current offset; ReadAt and WriteAt do not use it.
+type File struct {
+	// read-only
+	ino       Inode
+	allocator storage.Allocator
+
+	m   *sync.Mutex
+	pos int64
+}
+
+func NewFile(ino Inode, allocator storage.Allocator) *File {
+	return &File{
+		ino:       ino,
+		allocator: allocator,
+		m:         new(sync.Mutex),
+		pos:       0,
+	}
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	n := copy(p, f.ino.ReadAt(uint64(off), uint64(len(p))))
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt.
+//
+// WriteAt either writes all of p or returns an error from the inode, having
+// written nothing.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	err := f.ino.WriteAt(uint64(off), p, f.allocator)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read implements io.Reader, reading from the current offset.
+func (f *File) Read(p []byte) (int, error) {
+	f.m.Lock()
+	n, err := f.ReadAt(p, f.pos)
+	f.pos = f.pos + int64(n)
+	f.m.Unlock()
+	if n > 0 && err == io.EOF {
+		// report EOF on the next read instead
+		return n, nil
+	}
+	return n, err
+}
+
+// Write implements io.Writer, writing at the current offset.
+func (f *File) Write(p []byte) (int, error) {
+	f.m.Lock()
+	n, err := f.WriteAt(p, f.pos)
+	f.pos = f.pos + int64(n)
+	f.m.Unlock()
+	return n, err
+}
+
+// Seek implements io.Seeker. Seeking past the end is allowed; a later write
+// there fills the gap with zeros.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart && whence != io.SeekCurrent && whence != io.SeekEnd {
+		return 0, errWhence
+	}
+	f.m.Lock()
+	var base int64 = 0
+	if whence == io.SeekCurrent {
+		base = f.pos
+	}
+	if whence == io.SeekEnd {
+		base = int64(f.ino.ByteSize())
+	}
+	pos := base + offset
+	if pos < 0 {
+		f.m.Unlock()
+		return 0, ErrNegativeOffset
+	}
+	f.pos = pos
+	f.m.Unlock()
+	return pos, nil
+}
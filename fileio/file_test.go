@@ -0,0 +1,133 @@
+package fileio
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+	indirect_inode "github.com/mit-pdos/perennial-examples/indirect_inode"
+	"github.com/mit-pdos/perennial-examples/inode"
+)
+
+var _ io.ReaderAt = (*File)(nil)
+var _ io.WriterAt = (*File)(nil)
+var _ io.ReadWriteSeeker = (*File)(nil)
+
+// newFiles returns an empty file backed by each kind of inode
+func newFiles() map[string]*File {
+	d1 := disk.NewMemDisk(10)
+	d2 := disk.NewMemDisk(10)
+	return map[string]*File{
+		"inode": NewFile(inode.Open(d1, 0),
+			alloc.New(1, 9, alloc.AddrSet{})),
+		"indirect_inode": NewFile(indirect_inode.Open(d2, 0),
+			alloc.New(1, 9, alloc.AddrSet{})),
+	}
+}
+
+func TestFileReadWrite(t *testing.T) {
+	for name, f := range newFiles() {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			n, err := f.Write([]byte("hello "))
+			assert.NoError(err)
+			assert.Equal(6, n)
+			_, err = io.WriteString(f, "world")
+			assert.NoError(err)
+
+			pos, err := f.Seek(0, io.SeekStart)
+			assert.NoError(err)
+			assert.Equal(int64(0), pos)
+			data, err := io.ReadAll(f)
+			assert.NoError(err)
+			assert.Equal("hello world", string(data))
+
+			n, err = f.Read(make([]byte, 1))
+			assert.Equal(0, n)
+			assert.Equal(io.EOF, err)
+		})
+	}
+}
+
+func TestFileAt(t *testing.T) {
+	for name, f := range newFiles() {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			bs := int64(disk.BlockSize)
+			_, err := f.WriteAt([]byte("abc"), bs-1)
+			assert.NoError(err)
+
+			p := make([]byte, 2)
+			n, err := f.ReadAt(p, bs)
+			assert.NoError(err)
+			assert.Equal(2, n)
+			assert.Equal("bc", string(p))
+
+			n, err = f.ReadAt(p, bs+1)
+			assert.Equal(1, n)
+			assert.Equal(io.EOF, err)
+
+			_, err = f.ReadAt(p, 0)
+			assert.NoError(err)
+			assert.Equal([]byte{0, 0}, p, "gap should read as zeros")
+
+			_, err = f.ReadAt(p, -1)
+			assert.Equal(ErrNegativeOffset, err)
+			_, err = f.WriteAt(p, -1)
+			assert.Equal(ErrNegativeOffset, err)
+		})
+	}
+}
+
+func TestFileSeek(t *testing.T) {
+	for name, f := range newFiles() {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			f.Write([]byte("0123456789"))
+
+			pos, err := f.Seek(-3, io.SeekEnd)
+			assert.NoError(err)
+			assert.Equal(int64(7), pos)
+			pos, err = f.Seek(1, io.SeekCurrent)
+			assert.NoError(err)
+			assert.Equal(int64(8), pos)
+			p := make([]byte, 5)
+			n, _ := f.Read(p)
+			assert.Equal("89", string(p[:n]))
+
+			_, err = f.Seek(-1, io.SeekStart)
+			assert.Equal(ErrNegativeOffset, err)
+			_, err = f.Seek(0, 42)
+			assert.Error(err)
+
+			// seeking past the end and writing leaves a zero-filled gap
+			f.Seek(12, io.SeekStart)
+			f.Write([]byte("x"))
+			data := make([]byte, 13)
+			n, _ = f.ReadAt(data, 0)
+			assert.Equal(13, n)
+			assert.Equal("0123456789\x00\x00x", string(data))
+		})
+	}
+}
+
+func TestFileWriteNoSpace(t *testing.T) {
+	for name, f := range newFiles() {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			f.Write([]byte("abc"))
+			// more blocks than are free
+			n, err := f.Write(make([]byte, 10*disk.BlockSize))
+			assert.Equal(errs.ErrNoSpace, err)
+			assert.Equal(0, n)
+			pos, _ := f.Seek(0, io.SeekCurrent)
+			assert.Equal(int64(3), pos)
+			end, _ := f.Seek(0, io.SeekEnd)
+			assert.Equal(int64(3), end, "failed write should not change the size")
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package inode
+
+import (
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
+)
+
+// Maximum size of inode, in bytes.
+const MaxBytes uint64 = MaxBlocks * disk.BlockSize
+
+func max(a, b uint64) uint64 {
+	if a >= b {
+		return a
+	}
+	return b
+}
+
+// ByteSize returns the size of the inode in bytes.
+func (i *Inode) ByteSize() uint64 {
+	i.m.Lock()
+	sz := i.byteLen
+	i.m.Unlock()
+	return sz
+}
+
+// ReadAt returns n bytes of the inode starting at byte offset off, or fewer
+// if the inode ends first.
+func (i *Inode) ReadAt(off uint64, n uint64) []byte {
+	i.m.Lock()
+	var data = make([]byte, 0)
+	var pos = off
+	end := off + min(n, i.byteLen-min(off, i.byteLen))
+	for pos < end {
+		blkStart := pos / disk.BlockSize * disk.BlockSize
+		blkEnd := min(blkStart+disk.BlockSize, end)
+		b := i.read(pos / disk.BlockSize)
+		data = append(data, b[pos-blkStart:blkEnd-blkStart]...)
+		pos = blkEnd
+	}
+	i.m.Unlock()
+	return data
+}
+
+// prepareBlock returns the contents of block blk after writing data at byte
+// offset off
+//
+// Requires the lock to be held.
+func (i *Inode) prepareBlock(blk uint64, off uint64, data []byte) disk.Block {
+	blkStart := blk * disk.BlockSize
+	blkEnd := blkStart + disk.BlockSize
+	b := make(disk.Block, disk.BlockSize)
+	if blk < i.size {
+		copy(b, i.read(blk))
+	}
+	// anything past the old end reads as zero
+	if i.byteLen < blkEnd {
+		for k := max(i.byteLen, blkStart); k < blkEnd; k++ {
+			b[k-blkStart] = 0
+		}
+	}
+	end := off + uint64(len(data))
+	lo := max(off, blkStart)
+	hi := min(end, blkEnd)
+	if lo < hi {
+		copy(b[lo-blkStart:hi-blkStart], data[lo-off:hi-off])
+	}
+	return b
+}
+
+func freeAll(allocator storage.Allocator, addrs []uint64) {
+	for _, a := range addrs {
+		allocator.Free(a)
+	}
+}
+
+// writeAt is the critical section for WriteAt
+//
+// Requires the lock to be held.
+func (i *Inode) writeAt(off uint64, data []byte, allocator storage.Allocator) error {
+	end := off + uint64(len(data))
+	// start from the old end if there is a gap, so the gap gets zeroed
+	firstBlk := min(off, i.byteLen) / disk.BlockSize
+	lastBlk := (end - 1) / disk.BlockSize
+	newSize := max(i.size, lastBlk+1)
+
+	// write the new data blocks
+	var reserved []uint64
+	newData := make(map[uint64]uint64)
+	for blk := firstBlk; blk <= lastBlk; blk++ {
+		a, ok := allocator.Reserve()
+		if !ok {
+			freeAll(allocator, reserved)
+			return errs.ErrNoSpace
+		}
+		i.d.Write(a, i.prepareBlock(blk, off, data))
+		reserved = append(reserved, a)
+		newData[blk] = a
+	}
+
+	// write new copies of the indirect blocks that point to new data blocks
+	var newIndirect = append([]uint64{}, i.indirect...)
+	var freed []uint64
+	if lastBlk >= maxDirect {
+		for n := indNum(max(firstBlk, maxDirect)); n <= indNum(lastBlk); n++ {
+			a, ok := allocator.Reserve()
+			if !ok {
+				freeAll(allocator, reserved)
+				return errs.ErrNoSpace
+			}
+			reserved = append(reserved, a)
+			var addrs = make([]uint64, indirectNumBlocks)
+			if n < uint64(len(i.indirect)) {
+				addrs = readIndirect(i.d, i.indirect[n])
+				freed = append(freed, i.indirect[n])
+			}
+			for k := uint64(0); k < indirectNumBlocks; k++ {
+				a2, ok2 := newData[maxDirect+n*indirectNumBlocks+k]
+				if ok2 {
+					addrs[k] = a2
+				}
+			}
+			i.d.Write(a, prepIndirect(addrs))
+			if n < uint64(len(newIndirect)) {
+				newIndirect[n] = a
+			} else {
+				newIndirect = append(newIndirect, a)
+			}
+		}
+	}
+	// make the reservations durable before the inode points to them
+	allocator.Flush()
+
+	// the old data blocks that are replaced
+	oldEnd := min(i.size, lastBlk+1)
+	if firstBlk < oldEnd {
+		freed = append(freed, i.dataAddrs(firstBlk)[:oldEnd-firstBlk]...)
+	}
+
+	for blk := firstBlk; blk <= lastBlk && blk < maxDirect; blk++ {
+		if blk < uint64(len(i.direct)) {
+			i.direct[blk] = newData[blk]
+		} else {
+			i.direct = append(i.direct, newData[blk])
+		}
+	}
+	i.indirect = newIndirect
+	i.size = newSize
+	i.byteLen = max(i.byteLen, end)
+	i.inSize() // crash commit point
+	freeAll(allocator, freed)
+	return nil
+}
+
+// WriteAt writes data to the inode at byte offset off, extending it if
+// necessary. If off is past the end of the inode, the gap reads as zeros.
+//
+// Every data block that changes is written to a newly allocated block, along
+// with new copies of the indirect blocks that point to them, and then a single
+// header write installs all of them along with the new length. A crash
+// therefore leaves either all of data or none of it.
+//
+// Returns errs.ErrInodeFull if the inode would grow past MaxBytes, or
+// errs.ErrNoSpace if the allocator is out of space; either way nothing is
+// written.
+func (i *Inode) WriteAt(off uint64, data []byte, allocator storage.Allocator) error {
+	n := uint64(len(data))
+	if off > MaxBytes || n > MaxBytes-off {
+		return errs.ErrInodeFull
+	}
+	if n == 0 {
+		return nil
+	}
+	i.m.Lock()
+	err := i.writeAt(off, data, allocator)
+	i.m.Unlock()
+	return err
+}
@@ -0,0 +1,136 @@
+package inode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+)
+
+func TestInodeWriteAtReadAt(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10)
+	allocator := alloc.New(1, 9, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.WriteAt(0, []byte("hello"), allocator))
+	assert.Equal(uint64(5), ino.ByteSize())
+	assert.Equal(uint64(1), ino.Size())
+	assert.Equal([]byte("hello"), ino.ReadAt(0, 100))
+	assert.Equal([]byte("ll"), ino.ReadAt(2, 2))
+	assert.Equal([]byte{}, ino.ReadAt(10, 2), "read past end")
+
+	// overwrite across a block boundary
+	data := bytes.Repeat([]byte("x"), 10)
+	assert.NoError(ino.WriteAt(disk.BlockSize-5, data, allocator))
+	assert.Equal(disk.BlockSize+5, ino.ByteSize())
+	assert.Equal(uint64(2), ino.Size())
+	assert.Equal(data, ino.ReadAt(disk.BlockSize-5, 10))
+	assert.Equal([]byte("hello"), ino.ReadAt(0, 5))
+}
+
+func TestInodeWriteAtIndirect(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(maxDirect + 10)
+	allocator := alloc.New(1, maxDirect+9, alloc.AddrSet{})
+	ino := Open(d, 0)
+	// the gap up to here reads as zeros, and the write ends in the first
+	// indirect block
+	off := maxDirect*disk.BlockSize - 2
+	assert.NoError(ino.WriteAt(off, []byte("abcd"), allocator))
+	assert.Equal(off+4, ino.ByteSize())
+	assert.Equal(maxDirect+1, ino.Size())
+	assert.Equal(make([]byte, 10), ino.ReadAt(off-10, 10))
+	assert.Equal([]byte("abcd"), ino.ReadAt(off, 10))
+
+	// overwrite in place in the indirect block
+	assert.NoError(ino.WriteAt(off+3, []byte("xy"), allocator))
+	assert.Equal([]byte("abcxy"), ino.ReadAt(off, 10))
+
+	ino2 := Open(d, 0)
+	assert.Equal(off+5, ino2.ByteSize())
+	assert.Equal([]byte("abcxy"), ino2.ReadAt(off, 10))
+}
+
+func TestInodeAppendAfterWriteAt(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10)
+	allocator := alloc.New(1, 9, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.WriteAt(0, []byte("abc"), allocator))
+	partial := ino.UsedBlocks()[0]
+	assert.NoError(ino.AppendErr(makeBlock(1), allocator))
+	assert.Equal(partial, ino.UsedBlocks()[0], "append should not rewrite the partial block")
+	assert.Equal(2*disk.BlockSize, ino.ByteSize())
+	assert.Equal(makeBlock(1), ino.Read(1))
+	first := ino.Read(0)
+	assert.Equal([]byte("abc"), []byte(first[:3]))
+	assert.Equal(make([]byte, disk.BlockSize-3), []byte(first[3:]),
+		"unused part of the partial block should be zero")
+}
+
+func TestInodeWriteAtTruncated(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10)
+	allocator := alloc.New(1, 9, alloc.AddrSet{})
+	ino := Open(d, 0)
+	ino.Append(makeBlock(1), allocator)
+	ino.Append(bytes.Repeat([]byte{7}, int(disk.BlockSize)), allocator)
+	assert.NoError(ino.Truncate(1, allocator))
+	assert.NoError(ino.WriteAt(disk.BlockSize+10, []byte{1}, allocator))
+	assert.Equal(make([]byte, 10), ino.ReadAt(disk.BlockSize, 10),
+		"old contents should not reappear")
+}
+
+func TestInodeWriteAtNoSpace(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(4)
+	allocator := alloc.New(1, 3, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.WriteAt(0, []byte("abc"), allocator))
+	// needs three new blocks, but only two are free
+	err := ino.WriteAt(1, make([]byte, 2*disk.BlockSize), allocator)
+	assert.Equal(errs.ErrNoSpace, err)
+	assert.Equal(uint64(3), ino.ByteSize(), "failed write should not change size")
+	assert.Equal([]byte("abc"), ino.ReadAt(0, 10))
+	// the blocks reserved for the failed write should have been freed
+	assert.NoError(ino.WriteAt(1, []byte("x"), allocator))
+	assert.Equal([]byte("axc"), ino.ReadAt(0, 10))
+
+	assert.Equal(errs.ErrInodeFull, ino.WriteAt(MaxBytes, []byte("x"), allocator))
+}
+
+func TestInodeWriteAtIndirectNoSpace(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(maxDirect + 2)
+	allocator := alloc.New(1, maxDirect+1, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.WriteAt(0, make([]byte, maxDirect*disk.BlockSize), allocator))
+	// the block after the direct blocks is free, but there is no room for the
+	// indirect block pointing to it
+	err := ino.WriteAt(maxDirect*disk.BlockSize, []byte("x"), allocator)
+	assert.Equal(errs.ErrNoSpace, err)
+	assert.Equal(maxDirect, ino.Size())
+	assert.Equal(maxDirect*disk.BlockSize, ino.ByteSize())
+	_, ok := allocator.Reserve()
+	assert.True(ok, "reserved data block should have been freed")
+}
+
+func TestInodeWriteAtFreesOld(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(maxDirect + 10)
+	allocator := alloc.New(1, maxDirect+9, alloc.AddrSet{})
+	ino := Open(d, 0)
+	last := (maxDirect + 1) * disk.BlockSize
+	assert.NoError(ino.WriteAt(0, make([]byte, last+disk.BlockSize), allocator))
+	// each overwrite needs a new data and indirect block, so this runs out of
+	// space unless the old ones are freed
+	for i := 0; i < 50; i++ {
+		assert.NoError(ino.WriteAt(last, []byte{byte(i)}, allocator))
+	}
+	assert.Equal([]byte{49}, ino.ReadAt(last, 1))
+	assert.Len(Open(d, 0).UsedBlocks(), int(maxDirect+2+1))
+}
@@ -3,14 +3,16 @@ package inode
 import (
 	"sync"
 
-	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
 	"github.com/tchajed/goose/machine/disk"
 	"github.com/tchajed/marshal"
 )
 
 // on-disk layout of inode:
 // [ size: u64 -- number of blocks in inode |
-//   direct: [500]u64 -- number valid determined by size |
+//   byteLen: u64 -- number of bytes in inode |
+//   direct: [499]u64 -- number valid determined by size |
 //   numIndirect: u64 --number of indirect blocks
 //   indirect: [10]u64 -- number valid determined by numIndirect ]
 //
@@ -18,11 +20,15 @@ import (
 // [ direct: [512]u64 -- direct blocks ]
 //
 // note that a "direct block" means the address of a block of data
+//
+// byteLen is at most size*BlockSize. Append treats every block as full, while
+// WriteAt can leave the last block partially used. Bytes in the last block
+// past byteLen are always zero.
 
 // Maximum size of inode, in blocks.
-const MaxBlocks uint64 = 500 + 10*512
+const MaxBlocks uint64 = 499 + 10*512
 
-const maxDirect uint64 = 500
+const maxDirect uint64 = 499
 const maxIndirect uint64 = 10
 const indirectNumBlocks uint64 = 512
 
@@ -31,6 +37,7 @@ type Inode struct {
 	m        *sync.Mutex
 	addr     uint64 // address on disk where inode is stored
 	size     uint64
+	byteLen  uint64
 	direct   []uint64 // addresses of data blocks
 	indirect []uint64 // addresses of indirect blocks
 }
@@ -46,6 +53,7 @@ func Open(d disk.Disk, addr uint64) *Inode {
 	b := d.Read(addr)
 	dec := marshal.NewDec(b)
 	size := dec.GetInt()
+	byteLen := dec.GetInt()
 	direct := dec.GetInts(maxDirect)
 	indirect := dec.GetInts(maxIndirect)
 	numIndirect := dec.GetInt()
@@ -54,6 +62,7 @@ func Open(d disk.Disk, addr uint64) *Inode {
 		d:        d,
 		m:        new(sync.Mutex),
 		size:     size,
+		byteLen:  byteLen,
 		addr:     addr,
 		direct:   direct[:numDirect],
 		indirect: indirect[:numIndirect],
@@ -72,47 +81,70 @@ func prepIndirect(addrs []uint64) disk.Block {
 	return enc.Finish()
 }
 
+func indNum(off uint64) uint64 {
+	return (off - maxDirect) / indirectNumBlocks
+}
+
+func indOff(off uint64) uint64 {
+	return (off - maxDirect) % indirectNumBlocks
+}
+
+// dataAddrs returns the addresses of data blocks from offset start to the end
+// of the inode
+//
+// Only entries of indirect blocks that are within the inode's size are
+// included, since entries past the end may be stale.
+func (i *Inode) dataAddrs(start uint64) []uint64 {
+	var addrs = make([]uint64, 0)
+	for off := start; off < min(i.size, maxDirect); off++ {
+		addrs = append(addrs, i.direct[off])
+	}
+	for n, blkAddr := range i.indirect {
+		// offset of the first block in this indirect block
+		first := maxDirect + uint64(n)*indirectNumBlocks
+		if first+indirectNumBlocks > start {
+			entries := readIndirect(i.d, blkAddr)
+			for k := uint64(0); k < indirectNumBlocks; k++ {
+				off := first + k
+				if off >= start && off < i.size {
+					addrs = append(addrs, entries[k])
+				}
+			}
+		}
+	}
+	return addrs
+}
+
 func (i *Inode) UsedBlocks() []uint64 {
 	var addrs []uint64
 	addrs = make([]uint64, 0)
-	direct := i.direct
-	indirect := i.indirect
-	for _, a := range direct {
-		addrs = append(addrs, a)
-	}
 	// append all addrs pointing to indirect blocks
-	for _, blkAddr := range indirect {
+	for _, blkAddr := range i.indirect {
 		addrs = append(addrs, blkAddr)
 	}
-	// append all addrs inside indirect blocks pointing to blocks
-	for _, blkAddr := range indirect {
-		addrs = append(addrs, readIndirect(i.d, blkAddr)...)
-	}
+	// append all addrs pointing to data blocks
+	addrs = append(addrs, i.dataAddrs(0)...)
 	return addrs
 }
 
-func indNum(off uint64) uint64 {
-	return (off - maxDirect) / indirectNumBlocks
-}
-
-func indOff(off uint64) uint64 {
-	return (off - maxDirect) % indirectNumBlocks
-}
-
-func (i *Inode) Read(off uint64) disk.Block {
-	i.m.Lock()
+// read returns block off
+//
+// Requires the lock to be held.
+func (i *Inode) read(off uint64) disk.Block {
 	if off >= i.size {
-		i.m.Unlock()
 		return nil
 	}
 	if off < maxDirect {
 		a := i.direct[off]
-		b := i.d.Read(a)
-		i.m.Unlock()
-		return b
+		return i.d.Read(a)
 	}
 	addrs := readIndirect(i.d, i.indirect[indNum(off)])
-	b := i.d.Read(addrs[indOff(off)])
+	return i.d.Read(addrs[indOff(off)])
+}
+
+func (i *Inode) Read(off uint64) disk.Block {
+	i.m.Lock()
+	b := i.read(off)
 	i.m.Unlock()
 	return b
 }
@@ -134,6 +166,7 @@ func (i *Inode) mkHdr() disk.Block {
 	enc := marshal.NewEnc(disk.BlockSize)
 	// sz
 	enc.PutInt(i.size)
+	enc.PutInt(i.byteLen)
 	// direct_s
 	enc.PutInts(i.direct)
 	padInts(enc, maxDirect-uint64(len(i.direct)))
@@ -155,7 +188,6 @@ func (i *Inode) inSize() {
 // checkTotalSize determines that the inode is not already at maximum size
 //
 // Requires the lock to be held.
-//
 func (i *Inode) checkTotalSize() bool {
 	if i.size >= MaxBlocks {
 		return false
@@ -209,48 +241,115 @@ func (i *Inode) appendIndirect(a uint64) bool {
 	return true
 }
 
-// Append adds a block to the inode.
+// appendBlock adds a block with contents b to the inode, and sets its length
+// to byteLen in the same header write
 //
-// Returns false on failure (if the allocator or inode are out of space)
-func (i *Inode) Append(b disk.Block, allocator *alloc.Allocator) bool {
-	i.m.Lock()
-
+// Requires the lock to be held.
+func (i *Inode) appendBlock(b disk.Block, byteLen uint64, allocator storage.Allocator) error {
 	ok := i.checkTotalSize()
 	if !ok {
-		i.m.Unlock()
-		return false
+		return errs.ErrInodeFull
 	}
 
 	a, ok2 := allocator.Reserve()
 	if !ok2 {
-		i.m.Unlock()
-		return false
+		return errs.ErrNoSpace
 	}
 	i.d.Write(a, b)
+	// make the reservation durable before the inode points to a
+	allocator.Flush()
 
+	oldLen := i.byteLen
+	i.byteLen = byteLen
 	ok3 := i.appendDirect(a)
 	if ok3 {
-		i.m.Unlock()
-		return true
+		return nil
 	}
 
 	ok4 := i.appendIndirect(a)
 	if ok4 {
-		i.m.Unlock()
-		return true
+		return nil
 	}
 
 	// we need to allocate a new indirect block
 	// and put the data there
 	indAddr, ok := allocator.Reserve()
 	if !ok {
-		i.m.Unlock()
+		i.byteLen = oldLen
 		allocator.Free(a)
-		return false
+		return errs.ErrNoSpace
 	}
 
+	allocator.Flush()
 	i.indirect = append(i.indirect, indAddr)
 	i.writeIndirect(indAddr, []uint64{a})
+	return nil
+}
+
+// AppendErr adds a block to the inode.
+//
+// Returns errs.ErrInodeFull if the inode is at MaxBlocks, or errs.ErrNoSpace
+// if the allocator is out of space (for either the data or a new indirect
+// block).
+func (i *Inode) AppendErr(b disk.Block, allocator storage.Allocator) error {
+	i.m.Lock()
+	if !i.checkTotalSize() {
+		i.m.Unlock()
+		return errs.ErrInodeFull
+	}
+	// the unused part of a partial last block is already zero
+	err := i.appendBlock(b, (i.size+1)*disk.BlockSize, allocator)
 	i.m.Unlock()
-	return true
+	return err
+}
+
+// Append adds a block to the inode.
+//
+// Returns false on failure (if the allocator or inode are out of space)
+func (i *Inode) Append(b disk.Block, allocator storage.Allocator) bool {
+	return i.AppendErr(b, allocator) == nil
+}
+
+// FlushErr does nothing, since AppendErr makes each block durable before
+// returning.
+func (i *Inode) FlushErr(allocator storage.Allocator) error {
+	return nil
+}
+
+// numIndirectFor returns the number of indirect blocks needed for an inode
+// with size blocks
+func numIndirectFor(size uint64) uint64 {
+	if size <= maxDirect {
+		return 0
+	}
+	return indNum(size-1) + 1
+}
+
+// Truncate shrinks the inode to newSize blocks, freeing the data blocks past
+// the new end and any indirect blocks that are no longer needed.
+//
+// The shorter header is written before anything is freed, so a crash never
+// leaves the inode pointing to freed blocks.
+//
+// Returns errs.ErrInvalidOffset if newSize is larger than Size().
+func (i *Inode) Truncate(newSize uint64, allocator storage.Allocator) error {
+	i.m.Lock()
+	if newSize > i.size {
+		i.m.Unlock()
+		return errs.ErrInvalidOffset
+	}
+	dropped := i.dataAddrs(newSize)
+	numIndirect := numIndirectFor(newSize)
+	// copy, since later appends reuse the space in i.direct and i.indirect
+	dropped = append(dropped, i.indirect[numIndirect:]...)
+	i.size = newSize
+	i.byteLen = min(i.byteLen, newSize*disk.BlockSize)
+	i.direct = i.direct[:min(newSize, maxDirect)]
+	i.indirect = i.indirect[:numIndirect]
+	i.inSize()
+	i.m.Unlock()
+	for _, a := range dropped {
+		allocator.Free(a)
+	}
+	return nil
 }
@@ -7,6 +7,9 @@ import (
 	"github.com/tchajed/goose/machine/disk"
 
 	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
+	"github.com/mit-pdos/perennial-examples/storage/storagetest"
 )
 
 func makeBlock(x byte) disk.Block {
@@ -40,6 +43,72 @@ func TestInodeAppendFill(t *testing.T) {
 	assert.Equal(false,
 		ino.Append(makeBlock(0), allocator),
 		"should not allow appending past InodeMaxBlocks")
+	assert.Equal(errs.ErrInodeFull, ino.AppendErr(makeBlock(0), allocator))
+}
+
+func TestInodeAppendErr(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(3)
+	allocator := alloc.New(1, 2, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.AppendErr(makeBlock(1), allocator))
+	assert.NoError(ino.AppendErr(makeBlock(2), allocator))
+	assert.Equal(errs.ErrNoSpace, ino.AppendErr(makeBlock(3), allocator))
+	assert.Equal(uint64(2), ino.Size(), "failed append should not change size")
+}
+
+func TestInodeTruncate(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(4)
+	allocator := alloc.New(1, 3, alloc.AddrSet{})
+	ino := Open(d, 0)
+	ino.Append(makeBlock(1), allocator)
+	ino.Append(makeBlock(2), allocator)
+	ino.Append(makeBlock(3), allocator)
+	assert.Equal(errs.ErrInvalidOffset, ino.Truncate(4, allocator))
+	assert.NoError(ino.Truncate(1, allocator))
+	assert.Nil(ino.Read(1))
+	assert.NoError(ino.AppendErr(makeBlock(4), allocator),
+		"truncated blocks should be freed")
+	assert.NoError(ino.AppendErr(makeBlock(5), allocator))
+
+	ino = Open(d, 0)
+	assert.Equal(uint64(3), ino.Size())
+	assert.Equal(makeBlock(4), ino.Read(1))
+	assert.Equal(makeBlock(5), ino.Read(2))
+}
+
+func TestInodeTruncateIndirect(t *testing.T) {
+	assert := assert.New(t)
+	sz := maxDirect + indirectNumBlocks + 10
+	d := disk.NewMemDisk(1 + sz + 2)
+	allocator := alloc.New(1, sz+2, alloc.AddrSet{})
+	ino := Open(d, 0)
+	for i := uint64(0); i < sz; i++ {
+		ino.Append(makeBlock(byte(i)), allocator)
+	}
+	assert.Len(ino.indirect, 2)
+
+	// drop the second indirect block and part of the first
+	assert.NoError(ino.Truncate(maxDirect+5, allocator))
+	assert.Len(ino.indirect, 1)
+	assert.Len(ino.UsedBlocks(), int(maxDirect+5+1),
+		"stale entries in the indirect block should not be counted")
+	ino = Open(d, 0)
+	assert.Len(ino.UsedBlocks(), int(maxDirect+5+1))
+	last := maxDirect + 4
+	assert.Equal(makeBlock(byte(last)), ino.Read(last))
+
+	// reuse the stale part of the indirect block
+	assert.NoError(ino.AppendErr(makeBlock(1), allocator))
+	assert.Equal(makeBlock(1), ino.Read(maxDirect+5))
+
+	assert.NoError(ino.Truncate(2, allocator))
+	assert.Len(ino.indirect, 0)
+	assert.Len(ino.UsedBlocks(), 2)
+	ino = Open(d, 0)
+	assert.Equal(uint64(2), ino.Size())
+	assert.Len(ino.UsedBlocks(), 2)
 }
 
 func TestInodeRecover(t *testing.T) {
@@ -54,3 +123,19 @@ func TestInodeRecover(t *testing.T) {
 	assert.Equal(makeBlock(2), i.Read(1))
 	assert.Len(i.UsedBlocks(), 2)
 }
+
+func TestInodeConformance(t *testing.T) {
+	storagetest.TestInode(t, storagetest.Impl{
+		MaxBlocks: MaxBlocks,
+		New: func(numBlocks uint64) storagetest.Instance {
+			// leave room for the indirect blocks
+			sz := numBlocks + numIndirectFor(numBlocks)
+			d := disk.NewMemDisk(1 + sz)
+			return storagetest.Instance{
+				Inode:     Open(d, 0),
+				Allocator: alloc.New(1, sz, alloc.AddrSet{}),
+				Reopen:    func() storage.Inode { return Open(d, 0) },
+			}
+		},
+	})
+}
@@ -0,0 +1,129 @@
+package inode
+
+import (
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
+)
+
+// Maximum size of inode, in bytes.
+const MaxBytes uint64 = MaxBlocks * disk.BlockSize
+
+func min(a, b uint64) uint64 {
+	if a <= b {
+		return a
+	}
+	return b
+}
+
+func max(a, b uint64) uint64 {
+	if a >= b {
+		return a
+	}
+	return b
+}
+
+// ReadAt returns n bytes of the inode starting at byte offset off, or fewer
+// if the inode ends first.
+func (i *Inode) ReadAt(off uint64, n uint64) []byte {
+	i.m.Lock()
+	var data = make([]byte, 0)
+	var pos = off
+	end := off + min(n, i.byteLen-min(off, i.byteLen))
+	for pos < end {
+		blkStart := pos / disk.BlockSize * disk.BlockSize
+		blkEnd := min(blkStart+disk.BlockSize, end)
+		b := i.read(pos / disk.BlockSize)
+		data = append(data, b[pos-blkStart:blkEnd-blkStart]...)
+		pos = blkEnd
+	}
+	i.m.Unlock()
+	return data
+}
+
+// prepareBlock returns the contents of block blk after writing data at byte
+// offset off
+//
+// Requires the lock to be held.
+func (i *Inode) prepareBlock(blk uint64, off uint64, data []byte) disk.Block {
+	blkStart := blk * disk.BlockSize
+	blkEnd := blkStart + disk.BlockSize
+	b := make(disk.Block, disk.BlockSize)
+	if blk < uint64(len(i.addrs)) {
+		copy(b, i.read(blk))
+	}
+	// anything past the old end reads as zero
+	if i.byteLen < blkEnd {
+		for k := max(i.byteLen, blkStart); k < blkEnd; k++ {
+			b[k-blkStart] = 0
+		}
+	}
+	end := off + uint64(len(data))
+	lo := max(off, blkStart)
+	hi := min(end, blkEnd)
+	if lo < hi {
+		copy(b[lo-blkStart:hi-blkStart], data[lo-off:hi-off])
+	}
+	return b
+}
+
+// WriteAt writes data to the inode at byte offset off, extending it if
+// necessary. If off is past the end of the inode, the gap reads as zeros.
+//
+// Every block that changes is written to a newly allocated block (reading
+// the old contents first if only part of it is overwritten), and then a
+// single header write installs all of them along with the new length. A crash
+// therefore leaves either all of data or none of it.
+//
+// Returns errs.ErrInodeFull if the inode would grow past MaxBytes, or
+// errs.ErrNoSpace if the allocator is out of space; either way nothing is
+// written.
+func (i *Inode) WriteAt(off uint64, data []byte, allocator storage.Allocator) error {
+	n := uint64(len(data))
+	if off > MaxBytes || n > MaxBytes-off {
+		return errs.ErrInodeFull
+	}
+	if n == 0 {
+		return nil
+	}
+	end := off + n
+	i.m.Lock()
+	// start from the old end if there is a gap, so the gap gets zeroed
+	firstBlk := min(off, i.byteLen) / disk.BlockSize
+	lastBlk := (end - 1) / disk.BlockSize
+	var newAddrs []uint64
+	for blk := firstBlk; blk <= lastBlk; blk++ {
+		a, ok := allocator.Reserve()
+		if !ok {
+			i.m.Unlock()
+			for _, a2 := range newAddrs {
+				allocator.Free(a2)
+			}
+			return errs.ErrNoSpace
+		}
+		i.d.Write(a, i.prepareBlock(blk, off, data))
+		newAddrs = append(newAddrs, a)
+	}
+	// make the reservations durable before the inode points to them
+	allocator.Flush()
+
+	var freed []uint64
+	for k, a := range newAddrs {
+		blk := firstBlk + uint64(k)
+		if blk < uint64(len(i.addrs)) {
+			freed = append(freed, i.addrs[blk])
+			i.addrs[blk] = a
+		} else {
+			i.addrs = append(i.addrs, a)
+		}
+	}
+	i.byteLen = max(i.byteLen, end)
+	hdr := i.mkHdr()
+	i.d.Write(i.addr, hdr) // crash commit point
+	i.m.Unlock()
+	for _, a := range freed {
+		allocator.Free(a)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package inode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+)
+
+func TestInodeWriteAtReadAt(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10)
+	allocator := alloc.New(1, 9, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.WriteAt(0, []byte("hello"), allocator))
+	assert.Equal(uint64(5), ino.ByteSize())
+	assert.Equal(uint64(1), ino.Size())
+	assert.Equal([]byte("hello"), ino.ReadAt(0, 100))
+	assert.Equal([]byte("ll"), ino.ReadAt(2, 2))
+	assert.Equal([]byte{}, ino.ReadAt(10, 2), "read past end")
+
+	// overwrite across a block boundary
+	data := bytes.Repeat([]byte("x"), 10)
+	assert.NoError(ino.WriteAt(disk.BlockSize-5, data, allocator))
+	assert.Equal(disk.BlockSize+5, ino.ByteSize())
+	assert.Equal(uint64(2), ino.Size())
+	assert.Equal(data, ino.ReadAt(disk.BlockSize-5, 10))
+	assert.Equal([]byte("hello"), ino.ReadAt(0, 5))
+}
+
+func TestInodeWriteAtGap(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10)
+	allocator := alloc.New(1, 9, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.WriteAt(0, []byte("abc"), allocator))
+	assert.NoError(ino.WriteAt(2*disk.BlockSize, []byte("z"), allocator))
+	assert.Equal(2*disk.BlockSize+1, ino.ByteSize())
+	data := ino.ReadAt(0, 3*disk.BlockSize)
+	assert.Equal(2*disk.BlockSize+1, uint64(len(data)))
+	assert.Equal([]byte("abc"), data[:3])
+	assert.Equal(make([]byte, 2*disk.BlockSize-3), data[3:2*disk.BlockSize],
+		"gap should read as zeros")
+	assert.Equal(byte('z'), data[2*disk.BlockSize])
+}
+
+func TestInodeWriteAtTruncated(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10)
+	allocator := alloc.New(1, 9, alloc.AddrSet{})
+	ino := Open(d, 0)
+	ino.Append(makeBlock(1), allocator)
+	ino.Append(bytes.Repeat([]byte{7}, int(disk.BlockSize)), allocator)
+	assert.NoError(ino.Truncate(1, allocator))
+	assert.NoError(ino.WriteAt(disk.BlockSize+10, []byte{1}, allocator))
+	assert.Equal(make([]byte, 10), ino.ReadAt(disk.BlockSize, 10),
+		"old contents should not reappear")
+}
+
+func TestInodeWriteAtNoSpace(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(3)
+	allocator := alloc.New(1, 2, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.WriteAt(0, []byte("abc"), allocator))
+	// needs two new blocks, but only one is free
+	err := ino.WriteAt(1, make([]byte, disk.BlockSize), allocator)
+	assert.Equal(errs.ErrNoSpace, err)
+	assert.Equal(uint64(3), ino.ByteSize(), "failed write should not change size")
+	assert.Equal([]byte("abc"), ino.ReadAt(0, 10))
+	// the block reserved for the failed write should have been freed
+	assert.NoError(ino.WriteAt(1, []byte("x"), allocator))
+	assert.Equal([]byte("axc"), ino.ReadAt(0, 10))
+
+	assert.Equal(errs.ErrInodeFull, ino.WriteAt(MaxBytes, []byte("x"), allocator))
+}
+
+func TestInodeWriteAtRecover(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10)
+	allocator := alloc.New(1, 9, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.WriteAt(100, []byte("hello"), allocator))
+	ino2 := Open(d, 0)
+	assert.Equal(uint64(105), ino2.ByteSize())
+	assert.Equal([]byte("hello"), ino2.ReadAt(100, 5))
+}
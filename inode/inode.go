@@ -6,11 +6,20 @@ import (
 	"github.com/tchajed/goose/machine/disk"
 	"github.com/tchajed/marshal"
 
-	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
 )
 
+// on-disk layout of inode:
+// [ numAddrs: u64 | byteLen: u64 | addrs: [numAddrs]u64 ]
+//
+// byteLen is the size of the inode in bytes, which is at most
+// numAddrs*BlockSize. The block-granularity methods (Append and Write) treat
+// every block as full, while WriteAt can leave the last block partially used.
+// Bytes in the last block past byteLen are always zero.
+
 // Maximum size of inode, in blocks.
-const MaxBlocks uint64 = 511
+const MaxBlocks uint64 = 510
 
 type Inode struct {
 	// read-only
@@ -19,19 +28,22 @@ type Inode struct {
 	addr uint64 // address on disk where inode is stored
 
 	// mutable
-	addrs []uint64 // addresses of data blocks
+	addrs   []uint64 // addresses of data blocks
+	byteLen uint64
 }
 
 func Open(d disk.Disk, addr uint64) *Inode {
 	b := d.Read(addr)
 	dec := marshal.NewDec(b)
 	numAddrs := dec.GetInt()
+	byteLen := dec.GetInt()
 	addrs := dec.GetInts(numAddrs)
 	return &Inode{
-		d:     d,
-		m:     new(sync.Mutex),
-		addr:  addr,
-		addrs: addrs,
+		d:       d,
+		m:       new(sync.Mutex),
+		addr:    addr,
+		addrs:   addrs,
+		byteLen: byteLen,
 	}
 }
 
@@ -64,9 +76,18 @@ func (i *Inode) Size() uint64 {
 	return sz
 }
 
+// ByteSize returns the size of the inode in bytes.
+func (i *Inode) ByteSize() uint64 {
+	i.m.Lock()
+	sz := i.byteLen
+	i.m.Unlock()
+	return sz
+}
+
 func (i *Inode) mkHdr() disk.Block {
 	enc := marshal.NewEnc(disk.BlockSize)
 	enc.PutInt(uint64(len(i.addrs)))
+	enc.PutInt(i.byteLen)
 	enc.PutInts(i.addrs)
 	hdr := enc.Finish()
 	return hdr
@@ -87,28 +108,128 @@ func (i *Inode) append(a uint64) bool {
 	}
 
 	i.addrs = append(i.addrs, a)
+	i.byteLen = uint64(len(i.addrs)) * disk.BlockSize
 	hdr := i.mkHdr()
 	i.d.Write(i.addr, hdr)
 	return true
 }
 
-// Append adds a block to the inode.
+// AppendErr adds a block to the inode.
 //
-// Returns false on failure (if the allocator or inode are out of space)
-func (i *Inode) Append(b disk.Block, allocator *alloc.Allocator) bool {
+// Returns errs.ErrInodeFull if the inode is at MaxBlocks, or errs.ErrNoSpace
+// if the allocator is out of space.
+func (i *Inode) AppendErr(b disk.Block, allocator storage.Allocator) error {
+	if i.Size() >= MaxBlocks {
+		return errs.ErrInodeFull
+	}
 	// allocate lock-free
 	a, ok := allocator.Reserve()
 	if !ok {
-		return false
+		return errs.ErrNoSpace
 	}
 	// prepare lock-free
 	i.d.Write(a, b)
+	// make the reservation durable before the inode points to a
+	allocator.Flush()
 
 	i.m.Lock()
 	ok2 := i.append(a)
 	i.m.Unlock()
 	if !ok2 {
+		// another append filled up the inode concurrently
+		allocator.Free(a)
+		return errs.ErrInodeFull
+	}
+	return nil
+}
+
+// Append adds a block to the inode.
+//
+// Returns false on failure (if the allocator or inode are out of space)
+func (i *Inode) Append(b disk.Block, allocator storage.Allocator) bool {
+	return i.AppendErr(b, allocator) == nil
+}
+
+// FlushErr does nothing, since AppendErr makes each block durable before
+// returning.
+func (i *Inode) FlushErr(allocator storage.Allocator) error {
+	return nil
+}
+
+// write replaces the block at offset off with the one stored at a
+//
+// Requires the lock to be held and off < len(i.addrs).
+//
+// Returns the old address, which no longer belongs to the inode.
+func (i *Inode) write(off uint64, a uint64) uint64 {
+	old := i.addrs[off]
+	i.addrs[off] = a
+	if i.byteLen < (off+1)*disk.BlockSize {
+		i.byteLen = (off + 1) * disk.BlockSize
+	}
+	hdr := i.mkHdr()
+	i.d.Write(i.addr, hdr)
+	return old
+}
+
+// Write replaces block off of the inode with b.
+//
+// Uses the shadow update pattern: b is written to a newly allocated block, the
+// header write swaps it in for the old block, and only then is the old block
+// freed. A crash leaves either the old or the new contents of block off.
+//
+// Returns errs.ErrInvalidOffset if off is not less than Size(), or
+// errs.ErrNoSpace if the allocator is out of space.
+func (i *Inode) Write(off uint64, b disk.Block, allocator storage.Allocator) error {
+	if off >= i.Size() {
+		return errs.ErrInvalidOffset
+	}
+	// allocate lock-free
+	a, ok := allocator.Reserve()
+	if !ok {
+		return errs.ErrNoSpace
+	}
+	// prepare lock-free
+	i.d.Write(a, b)
+	// make the reservation durable before the inode points to a
+	allocator.Flush()
+
+	i.m.Lock()
+	if off >= uint64(len(i.addrs)) {
+		i.m.Unlock()
+		allocator.Free(a)
+		return errs.ErrInvalidOffset
+	}
+	old := i.write(off, a)
+	i.m.Unlock()
+	allocator.Free(old)
+	return nil
+}
+
+// Truncate shrinks the inode to newSize blocks and frees the blocks past the
+// new end.
+//
+// The shorter header is written before anything is freed, so a crash never
+// leaves the inode pointing to freed blocks.
+//
+// Returns errs.ErrInvalidOffset if newSize is larger than Size().
+func (i *Inode) Truncate(newSize uint64, allocator storage.Allocator) error {
+	i.m.Lock()
+	if newSize > uint64(len(i.addrs)) {
+		i.m.Unlock()
+		return errs.ErrInvalidOffset
+	}
+	// copy, since later appends reuse the space in i.addrs
+	dropped := append([]uint64{}, i.addrs[newSize:]...)
+	i.addrs = i.addrs[:newSize]
+	if i.byteLen > newSize*disk.BlockSize {
+		i.byteLen = newSize * disk.BlockSize
+	}
+	hdr := i.mkHdr()
+	i.d.Write(i.addr, hdr)
+	i.m.Unlock()
+	for _, a := range dropped {
 		allocator.Free(a)
 	}
-	return ok2
+	return nil
 }
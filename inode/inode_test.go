@@ -7,6 +7,10 @@ import (
 	"github.com/tchajed/goose/machine/disk"
 
 	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/async_durable_alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
+	"github.com/mit-pdos/perennial-examples/storage/storagetest"
 )
 
 func makeBlock(x byte) disk.Block {
@@ -40,6 +44,73 @@ func TestInodeAppendFill(t *testing.T) {
 	assert.Equal(false,
 		ino.Append(makeBlock(0), allocator),
 		"should not allow appending past InodeMaxBlocks")
+	assert.Equal(errs.ErrInodeFull, ino.AppendErr(makeBlock(0), allocator))
+}
+
+func TestInodeAppendErr(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(3)
+	allocator := alloc.New(1, 2, alloc.AddrSet{})
+	ino := Open(d, 0)
+	assert.NoError(ino.AppendErr(makeBlock(1), allocator))
+	assert.NoError(ino.AppendErr(makeBlock(2), allocator))
+	assert.Equal(errs.ErrNoSpace, ino.AppendErr(makeBlock(3), allocator))
+	assert.Equal(uint64(2), ino.Size(), "failed append should not change size")
+}
+
+func TestInodeWrite(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(5)
+	allocator := alloc.New(1, 4, alloc.AddrSet{})
+	ino := Open(d, 0)
+	ino.Append(makeBlock(1), allocator)
+	ino.Append(makeBlock(2), allocator)
+	ino.Append(makeBlock(3), allocator)
+	assert.NoError(ino.Write(1, makeBlock(4), allocator))
+	assert.Equal(makeBlock(4), ino.Read(1))
+	// the only free block is now the old block 1
+	assert.NoError(ino.Write(1, makeBlock(5), allocator))
+	assert.Equal(errs.ErrInvalidOffset, ino.Write(3, makeBlock(6), allocator))
+
+	ino = Open(d, 0)
+	assert.Equal(uint64(3), ino.Size())
+	assert.Equal(makeBlock(1), ino.Read(0))
+	assert.Equal(makeBlock(5), ino.Read(1))
+	assert.Equal(makeBlock(3), ino.Read(2))
+}
+
+func TestInodeWriteNoSpace(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(2)
+	allocator := alloc.New(1, 1, alloc.AddrSet{})
+	ino := Open(d, 0)
+	ino.Append(makeBlock(1), allocator)
+	assert.Equal(errs.ErrNoSpace, ino.Write(0, makeBlock(2), allocator),
+		"shadow update needs a free block")
+	assert.Equal(makeBlock(1), ino.Read(0))
+}
+
+func TestInodeTruncate(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(4)
+	allocator := alloc.New(1, 3, alloc.AddrSet{})
+	ino := Open(d, 0)
+	ino.Append(makeBlock(1), allocator)
+	ino.Append(makeBlock(2), allocator)
+	ino.Append(makeBlock(3), allocator)
+	assert.Equal(errs.ErrInvalidOffset, ino.Truncate(4, allocator))
+	assert.NoError(ino.Truncate(1, allocator))
+	assert.Equal(uint64(1), ino.Size())
+	assert.Nil(ino.Read(1))
+	assert.NoError(ino.AppendErr(makeBlock(4), allocator),
+		"truncated blocks should be freed")
+	assert.NoError(ino.AppendErr(makeBlock(5), allocator))
+
+	ino = Open(d, 0)
+	assert.Equal(uint64(3), ino.Size())
+	assert.Equal(makeBlock(1), ino.Read(0))
+	assert.Equal(makeBlock(4), ino.Read(1))
+	assert.Equal(makeBlock(5), ino.Read(2))
 }
 
 func TestInodeRecover(t *testing.T) {
@@ -54,3 +125,46 @@ func TestInodeRecover(t *testing.T) {
 	assert.Equal(makeBlock(2), i.Read(1))
 	assert.Len(i.UsedBlocks(), 2)
 }
+
+func TestInodeConformance(t *testing.T) {
+	storagetest.TestInode(t, storagetest.Impl{
+		MaxBlocks: MaxBlocks,
+		New: func(numBlocks uint64) storagetest.Instance {
+			d := disk.NewMemDisk(1 + numBlocks)
+			return storagetest.Instance{
+				Inode:     Open(d, 0),
+				Allocator: alloc.New(1, numBlocks, alloc.AddrSet{}),
+				Reopen:    func() storage.Inode { return Open(d, 0) },
+			}
+		},
+	})
+}
+
+func TestInodeDurableAlloc(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10)
+	// inode at 0, allocator bitmap at 1
+	allocator := async_alloc.MkAlloc(d, 1)
+	allocator.MarkUsed(0)
+	allocator.MarkUsed(1)
+	for bn := uint64(10); bn < 8*disk.BlockSize; bn++ {
+		allocator.MarkUsed(bn)
+	}
+	allocator.Flush()
+	ino := Open(d, 0)
+	assert.NoError(ino.AppendErr(makeBlock(1), allocator))
+	assert.NoError(ino.Write(0, makeBlock(2), allocator))
+	assert.NoError(ino.WriteAt(disk.BlockSize, []byte("abc"), allocator))
+
+	// after a crash, the allocator should not hand out the inode's blocks
+	ino = Open(d, 0)
+	allocator = async_alloc.MkAlloc(d, 1)
+	for {
+		a, ok := allocator.Reserve()
+		if !ok {
+			break
+		}
+		assert.NotContains(ino.UsedBlocks(), a)
+	}
+	assert.Equal(makeBlock(2), ino.Read(0))
+}
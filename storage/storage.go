@@ -0,0 +1,44 @@
+// Interfaces shared by the inode and allocator variants, so that directories
+// can be built over any inode and inodes can use either a volatile or a
+// durable allocator.
+package storage
+
+import (
+	"github.com/tchajed/goose/machine/disk"
+)
+
+// Allocator hands out free disk blocks.
+//
+// alloc.Allocator keeps its state in memory, so it must be rebuilt on recovery
+// from the blocks in use, while async_alloc.Alloc stores a bitmap on disk.
+type Allocator interface {
+	// Reserve transfers ownership of a free block to the caller, or returns
+	// false if there are none.
+	Reserve() (uint64, bool)
+	// Free returns ownership of addr to the allocator.
+	Free(addr uint64)
+	// NumFree returns the number of free blocks.
+	NumFree() uint64
+	// Flush makes previous reservations durable, for allocators that store
+	// their state on disk. Inodes call Flush after reserving a block and
+	// before pointing to it, so a crash never leaves an inode using a block
+	// that the allocator considers free.
+	Flush()
+}
+
+// Inode is a sequence of blocks that supports appends.
+type Inode interface {
+	// Read returns block off, or nil if off is past the end.
+	Read(off uint64) disk.Block
+	// Size returns the number of blocks in the inode.
+	Size() uint64
+	// AppendErr adds a block to the inode, allocating from allocator.
+	// Depending on the variant, the new block might not be durable until
+	// FlushErr.
+	AppendErr(b disk.Block, allocator Allocator) error
+	// FlushErr makes all appended blocks durable.
+	FlushErr(allocator Allocator) error
+	// UsedBlocks returns the addresses owned by the inode, not including its
+	// header, for recovering an allocator.
+	UsedBlocks() []uint64
+}
@@ -0,0 +1,111 @@
+package storagetest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mit-pdos/perennial-examples/storage"
+)
+
+// AllocImpl describes an allocator implementation.
+type AllocImpl struct {
+	// New returns an allocator with exactly n free blocks. Reopen opens the
+	// allocator again from disk, as after a crash, or is nil if the allocator
+	// is not durable.
+	New func(n uint64) (allocator storage.Allocator, reopen func() storage.Allocator)
+}
+
+// TestAllocator runs the conformance tests against impl.
+func TestAllocator(t *testing.T, impl AllocImpl) {
+	t.Run("ReserveAll", func(t *testing.T) {
+		testReserveAll(t, impl)
+	})
+	t.Run("Free", func(t *testing.T) {
+		testFree(t, impl)
+	})
+	t.Run("Flush", func(t *testing.T) {
+		testFlush(t, impl)
+	})
+	t.Run("Concurrent", func(t *testing.T) {
+		testConcurrentReserve(t, impl)
+	})
+}
+
+func testReserveAll(t *testing.T, impl AllocImpl) {
+	assert := assert.New(t)
+	allocator, _ := impl.New(10)
+	assert.Equal(uint64(10), allocator.NumFree())
+	reserved := make(map[uint64]bool)
+	for i := uint64(0); i < 10; i++ {
+		a, ok := allocator.Reserve()
+		assert.True(ok, "reservation %d failed early", i)
+		assert.False(reserved[a], "reserved %d twice", a)
+		reserved[a] = true
+		assert.Equal(10-(i+1), allocator.NumFree())
+	}
+	_, ok := allocator.Reserve()
+	assert.False(ok, "all blocks should be reserved")
+	assert.Equal(uint64(0), allocator.NumFree())
+}
+
+func testFree(t *testing.T, impl AllocImpl) {
+	assert := assert.New(t)
+	allocator, _ := impl.New(3)
+	a1, _ := allocator.Reserve()
+	allocator.Reserve()
+	allocator.Reserve()
+	allocator.Free(a1)
+	assert.Equal(uint64(1), allocator.NumFree())
+	a, ok := allocator.Reserve()
+	assert.True(ok, "should use newly-freed block")
+	assert.Equal(a1, a)
+}
+
+func testFlush(t *testing.T, impl AllocImpl) {
+	assert := assert.New(t)
+	allocator, reopen := impl.New(10)
+	a1, _ := allocator.Reserve()
+	a2, _ := allocator.Reserve()
+	allocator.Free(a2)
+	allocator.Flush()
+	if reopen == nil {
+		return
+	}
+	allocator = reopen()
+	assert.Equal(uint64(9), allocator.NumFree(), "reservation should be durable")
+	for {
+		a, ok := allocator.Reserve()
+		if !ok {
+			break
+		}
+		assert.NotEqual(a1, a, "reserved block should not be reused")
+	}
+}
+
+func testConcurrentReserve(t *testing.T, impl AllocImpl) {
+	assert := assert.New(t)
+	allocator, _ := impl.New(100)
+	var m sync.Mutex
+	reserved := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				a, ok := allocator.Reserve()
+				if !ok {
+					return
+				}
+				m.Lock()
+				assert.False(reserved[a], "reserved %d twice", a)
+				reserved[a] = true
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(100, len(reserved))
+}
@@ -0,0 +1,140 @@
+// Conformance tests for implementations of storage.Inode, to be run from
+// each implementation's own tests.
+package storagetest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/storage"
+)
+
+// Instance is an empty inode to test.
+type Instance struct {
+	Inode     storage.Inode
+	Allocator storage.Allocator
+	// Reopen opens the inode again from disk, as after a crash.
+	Reopen func() storage.Inode
+}
+
+// Impl describes an inode implementation.
+type Impl struct {
+	// MaxBlocks is the maximum size of the inode, in blocks.
+	MaxBlocks uint64
+	// New returns an empty inode whose allocator has room for exactly
+	// numBlocks data blocks (plus any metadata blocks the inode needs).
+	New func(numBlocks uint64) Instance
+}
+
+func makeBlock(x byte) disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	b[0] = x
+	return b
+}
+
+// appendDurable appends b and then flushes it
+func appendDurable(ino storage.Inode, b disk.Block, allocator storage.Allocator) error {
+	err := ino.AppendErr(b, allocator)
+	if err != nil {
+		return err
+	}
+	return ino.FlushErr(allocator)
+}
+
+// TestInode runs the conformance tests against impl.
+func TestInode(t *testing.T, impl Impl) {
+	t.Run("AppendRead", func(t *testing.T) {
+		testAppendRead(t, impl)
+	})
+	t.Run("Recover", func(t *testing.T) {
+		testRecover(t, impl)
+	})
+	t.Run("NoSpace", func(t *testing.T) {
+		testNoSpace(t, impl)
+	})
+	t.Run("Full", func(t *testing.T) {
+		testFull(t, impl)
+	})
+	t.Run("UsedBlocks", func(t *testing.T) {
+		testUsedBlocks(t, impl)
+	})
+}
+
+func testAppendRead(t *testing.T, impl Impl) {
+	assert := assert.New(t)
+	inst := impl.New(10)
+	ino := inst.Inode
+	assert.Equal(uint64(0), ino.Size())
+	assert.Nil(ino.Read(0))
+	for i := byte(1); i <= 3; i++ {
+		assert.NoError(ino.AppendErr(makeBlock(i), inst.Allocator))
+	}
+	assert.Equal(uint64(3), ino.Size())
+	assert.Equal(makeBlock(1), ino.Read(0))
+	assert.Equal(makeBlock(3), ino.Read(2))
+	assert.Nil(ino.Read(3), "read past end")
+}
+
+func testRecover(t *testing.T, impl Impl) {
+	assert := assert.New(t)
+	inst := impl.New(10)
+	for i := byte(1); i <= 3; i++ {
+		assert.NoError(appendDurable(inst.Inode, makeBlock(i), inst.Allocator))
+	}
+	ino := inst.Reopen()
+	assert.Equal(uint64(3), ino.Size())
+	assert.Equal(makeBlock(1), ino.Read(0))
+	assert.Equal(makeBlock(3), ino.Read(2))
+}
+
+func testNoSpace(t *testing.T, impl Impl) {
+	assert := assert.New(t)
+	inst := impl.New(2)
+	assert.NoError(appendDurable(inst.Inode, makeBlock(1), inst.Allocator))
+	assert.NoError(appendDurable(inst.Inode, makeBlock(2), inst.Allocator))
+	err := appendDurable(inst.Inode, makeBlock(3), inst.Allocator)
+	assert.Equal(errs.ErrNoSpace, err)
+	ino := inst.Reopen()
+	assert.Equal(uint64(2), ino.Size(), "failed append should not be durable")
+	assert.Equal(makeBlock(2), ino.Read(1))
+}
+
+func testFull(t *testing.T, impl Impl) {
+	assert := assert.New(t)
+	inst := impl.New(impl.MaxBlocks + 1)
+	ino := inst.Inode
+	for i := uint64(0); i < impl.MaxBlocks; i++ {
+		err := ino.AppendErr(makeBlock(byte(i)), inst.Allocator)
+		if !assert.NoError(err, "append %d should fit", i) {
+			return
+		}
+	}
+	assert.Equal(errs.ErrInodeFull, ino.AppendErr(makeBlock(0), inst.Allocator))
+	assert.NoError(ino.FlushErr(inst.Allocator))
+	assert.Equal(impl.MaxBlocks, inst.Reopen().Size())
+}
+
+func testUsedBlocks(t *testing.T, impl Impl) {
+	assert := assert.New(t)
+	inst := impl.New(10)
+	for i := byte(1); i <= 3; i++ {
+		assert.NoError(appendDurable(inst.Inode, makeBlock(i), inst.Allocator))
+	}
+	used := make(map[uint64]bool)
+	for _, a := range inst.Reopen().UsedBlocks() {
+		used[a] = true
+	}
+	assert.GreaterOrEqual(len(used), 3, "each block should have its own address")
+	// the rest of the blocks are still free, and none of them are in use
+	for {
+		a, ok := inst.Allocator.Reserve()
+		if !ok {
+			break
+		}
+		assert.False(used[a], "allocator reserved %d, which is in use", a)
+		used[a] = true
+	}
+}
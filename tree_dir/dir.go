@@ -0,0 +1,193 @@
+package tree_dir
+
+import (
+	"sync"
+
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/inode"
+)
+
+// A directory is an inode.Inode whose data blocks each hold a table of
+// entries:
+//
+// [ num: u64 |
+//   entries: [num]{ addr: u64 | gen: u64 | isDir: u64 | nameLen: u64 |
+//                   name: [nameLen]byte } ]
+//
+// Every change to a directory commits with a single inode operation. Adding an
+// entry rewrites a block that has room for it with inode.Write (a shadow
+// update), or appends a new block if none does. Removing an entry rewrites its
+// block without it, or truncates the inode if that leaves empty blocks at the
+// end. Empty blocks elsewhere are reused by later adds, so a directory only
+// grows with the number of entries it holds, not the number of changes made
+// to it.
+
+// MaxNameLen is the maximum length of a name, in bytes.
+const MaxNameLen uint64 = 255
+
+// size of an entry without its name
+const entryHdrSize uint64 = 4 * 8
+
+type entry struct {
+	addr  uint64
+	gen   uint64
+	isDir bool
+	blk   uint64 // the directory block holding this entry
+}
+
+type dirNode struct {
+	// read-only
+	addr uint64
+	gen  uint64
+	ino  *inode.Inode
+
+	m       *sync.Mutex
+	entries map[string]entry
+	// names of the entries in each block of ino
+	blocks [][]string
+	// set once the directory has been removed from its parent
+	removed bool
+}
+
+func bool2int(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func entrySize(name string) uint64 {
+	return entryHdrSize + uint64(len(name))
+}
+
+// blockUsed returns the number of bytes a block with names takes up on disk
+func blockUsed(names []string) uint64 {
+	var sz uint64 = 8
+	for _, name := range names {
+		sz = sz + entrySize(name)
+	}
+	return sz
+}
+
+// mkBlock encodes the entries called names, taking e as the entry for newName
+// (which is not yet in dn.entries)
+//
+// Requires dn.m to be held.
+func (dn *dirNode) mkBlock(names []string, newName string, e entry) disk.Block {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(uint64(len(names)))
+	for _, name := range names {
+		var e2 = dn.entries[name]
+		if name == newName {
+			e2 = e
+		}
+		enc.PutInt(e2.addr)
+		enc.PutInt(e2.gen)
+		enc.PutInt(bool2int(e2.isDir))
+		enc.PutInt(uint64(len(name)))
+		enc.PutBytes([]byte(name))
+	}
+	return enc.Finish()
+}
+
+// readBlock adds the entries in b, which is block blk of the directory, to
+// entries and returns their names
+func readBlock(entries map[string]entry, blk uint64, b disk.Block) []string {
+	dec := marshal.NewDec(b)
+	num := dec.GetInt()
+	var names = make([]string, 0)
+	for k := uint64(0); k < num; k++ {
+		addr := dec.GetInt()
+		gen := dec.GetInt()
+		isDir := dec.GetInt()
+		nameLen := dec.GetInt()
+		name := string(dec.GetBytes(nameLen))
+		entries[name] = entry{addr: addr, gen: gen, isDir: isDir == 1, blk: blk}
+		names = append(names, name)
+	}
+	return names
+}
+
+// openDir recovers the directory whose inode is at addr
+func openDir(d disk.Disk, addr uint64, gen uint64) *dirNode {
+	ino := inode.Open(d, addr)
+	entries := make(map[string]entry)
+	var blocks [][]string
+	sz := ino.Size()
+	for off := uint64(0); off < sz; off++ {
+		blocks = append(blocks, readBlock(entries, off, ino.Read(off)))
+	}
+	return &dirNode{
+		addr:    addr,
+		gen:     gen,
+		ino:     ino,
+		m:       new(sync.Mutex),
+		entries: entries,
+		blocks:  blocks,
+		removed: false,
+	}
+}
+
+// add durably adds an entry called name for e
+//
+// Requires dn.m to be held and name to not be in dn.entries.
+func (dn *dirNode) add(name string, e entry, allocator *alloc.Allocator) error {
+	for k, names := range dn.blocks {
+		if blockUsed(names)+entrySize(name) <= disk.BlockSize {
+			blk := uint64(k)
+			newNames := append(append([]string{}, names...), name)
+			e.blk = blk
+			err := dn.ino.Write(blk, dn.mkBlock(newNames, name, e), allocator)
+			if err != nil {
+				return err
+			}
+			dn.blocks[blk] = newNames
+			dn.entries[name] = e
+			return nil
+		}
+	}
+	blk := uint64(len(dn.blocks))
+	e.blk = blk
+	err := dn.ino.AppendErr(dn.mkBlock([]string{name}, name, e), allocator)
+	if err != nil {
+		return err
+	}
+	dn.blocks = append(dn.blocks, []string{name})
+	dn.entries[name] = e
+	return nil
+}
+
+// remove durably removes the entry called name
+//
+// Requires dn.m to be held and name to be in dn.entries.
+func (dn *dirNode) remove(name string, allocator *alloc.Allocator) error {
+	blk := dn.entries[name].blk
+	var newNames = make([]string, 0)
+	for _, n := range dn.blocks[blk] {
+		if n != name {
+			newNames = append(newNames, n)
+		}
+	}
+	// the number of blocks left if the empty ones at the end are dropped
+	var newSize = uint64(len(dn.blocks))
+	for newSize > 0 && (newSize-1 == blk && len(newNames) == 0 ||
+		newSize-1 != blk && len(dn.blocks[newSize-1]) == 0) {
+		newSize--
+	}
+	var err error
+	if newSize <= blk {
+		err = dn.ino.Truncate(newSize, allocator)
+	} else {
+		err = dn.ino.Write(blk, dn.mkBlock(newNames, "", entry{}), allocator)
+	}
+	if err != nil {
+		return err
+	}
+	delete(dn.entries, name)
+	dn.blocks[blk] = newNames
+	dn.blocks = dn.blocks[:newSize]
+	return nil
+}
@@ -0,0 +1,466 @@
+// Hierarchical namespace of directories and files built out of inodes.
+//
+// Every directory and file is an inode.Inode, and all of their blocks come
+// from one shared alloc.Allocator. The root directory's inode is always at
+// block 0, and block 1 holds the last generation number handed out, so a
+// zeroed disk is an empty tree. Like dynamic_dir, nothing about free space is
+// stored on disk: Open rebuilds the allocator by walking every inode reachable
+// from the root.
+//
+// Every inode is created with a fresh generation number, which is stored in
+// its directory entry, so a handle to a removed file does not refer to a new
+// file that reuses its address. The generation is persisted before any entry
+// that uses it.
+//
+// Each directory has its own lock, which protects its entries. Operations
+// that change two directories' worth of state (Rmdir, which checks that the
+// child is empty) lock the parent before the child.
+package tree_dir
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/perennial-examples/alloc"
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/inode"
+)
+
+const rootAddr uint64 = 0
+
+// address of the block holding the last generation number
+const genAddr uint64 = 1
+
+// Ino identifies a directory or file in a Tree.
+type Ino struct {
+	Addr  uint64 // address of the inode's header
+	Gen   uint64 // generation number, unique to this inode
+	IsDir bool
+}
+
+// DirEntry is a named inode, as listed by ReadDir.
+type DirEntry struct {
+	Name string
+	Ino  Ino
+}
+
+type fileNode struct {
+	// read-only
+	gen uint64
+
+	m       *sync.Mutex
+	ino     *inode.Inode
+	removed bool
+}
+
+type Tree struct {
+	// read-only
+	d         disk.Disk
+	allocator *alloc.Allocator
+	root      *dirNode
+
+	// protects dirs, files and lastGen, but not the nodes in dirs and files
+	//
+	// Lock ordering: a dirNode's lock is acquired before m.
+	m       *sync.Mutex
+	dirs    map[uint64]*dirNode
+	files   map[uint64]*fileNode
+	lastGen uint64
+}
+
+func newFile(d disk.Disk, a uint64, gen uint64) *fileNode {
+	return &fileNode{gen: gen, m: new(sync.Mutex), ino: inode.Open(d, a), removed: false}
+}
+
+// Open recovers the tree on d, which has sz blocks.
+func Open(d disk.Disk, sz uint64) *Tree {
+	dirs := make(map[uint64]*dirNode)
+	files := make(map[uint64]*fileNode)
+	used := make(alloc.AddrSet)
+	var todo = []entry{{addr: rootAddr, gen: 0, isDir: true, blk: 0}}
+	for len(todo) > 0 {
+		a := todo[0].addr
+		dn := openDir(d, a, todo[0].gen)
+		todo = todo[1:]
+		dirs[a] = dn
+		alloc.SetAdd(used, []uint64{a})
+		alloc.SetAdd(used, dn.ino.UsedBlocks())
+		for _, e := range dn.entries {
+			if e.isDir {
+				todo = append(todo, e)
+			} else {
+				f := newFile(d, e.addr, e.gen)
+				files[e.addr] = f
+				alloc.SetAdd(used, []uint64{e.addr})
+				alloc.SetAdd(used, f.ino.UsedBlocks())
+			}
+		}
+	}
+	// reserve 2 blocks for the root directory and the generation number
+	allocator := alloc.New(2, sz-2, used)
+	lastGen := marshal.NewDec(d.Read(genAddr)).GetInt()
+	return &Tree{
+		d:         d,
+		allocator: allocator,
+		root:      dirs[rootAddr],
+		m:         new(sync.Mutex),
+		dirs:      dirs,
+		files:     files,
+		lastGen:   lastGen,
+	}
+}
+
+// newGen durably allocates a fresh generation number
+func (t *Tree) newGen() uint64 {
+	t.m.Lock()
+	gen := t.lastGen + 1
+	t.lastGen = gen
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(gen)
+	t.d.Write(genAddr, enc.Finish())
+	t.m.Unlock()
+	return gen
+}
+
+func validName(name string) bool {
+	return uint64(len(name)) > 0 && uint64(len(name)) <= MaxNameLen &&
+		name != "." && name != ".."
+}
+
+// splitPath returns the names in an absolute path, such as /a/b/c
+//
+// Empty components (from repeated or trailing slashes) are ignored.
+func splitPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, errs.ErrInvalidName
+	}
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if !validName(name) {
+			return nil, errs.ErrInvalidName
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (t *Tree) getDir(a uint64) *dirNode {
+	t.m.Lock()
+	dn := t.dirs[a]
+	t.m.Unlock()
+	return dn
+}
+
+func (t *Tree) getFile(a uint64) *fileNode {
+	t.m.Lock()
+	f := t.files[a]
+	t.m.Unlock()
+	return f
+}
+
+// walk returns the directory reached by following names from the root
+func (t *Tree) walk(names []string) (*dirNode, error) {
+	var dn = t.root
+	for _, name := range names {
+		dn.m.Lock()
+		e, ok := dn.entries[name]
+		dn.m.Unlock()
+		if !ok {
+			return nil, errs.ErrNotFound
+		}
+		if !e.isDir {
+			return nil, errs.ErrNotDir
+		}
+		dn = t.getDir(e.addr)
+		if dn == nil {
+			// removed concurrently
+			return nil, errs.ErrNotFound
+		}
+	}
+	return dn, nil
+}
+
+// walkParent returns the directory containing path and the last name in path
+func (t *Tree) walkParent(path string) (*dirNode, string, error) {
+	names, err := splitPath(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(names) == 0 {
+		// the root has no parent
+		return nil, "", errs.ErrInvalidName
+	}
+	parent, err := t.walk(names[:len(names)-1])
+	if err != nil {
+		return nil, "", err
+	}
+	return parent, names[len(names)-1], nil
+}
+
+func (t *Tree) freeInode(a uint64, ino *inode.Inode) {
+	t.allocator.Free(a)
+	for _, b := range ino.UsedBlocks() {
+		t.allocator.Free(b)
+	}
+}
+
+func (t *Tree) create(path string, isDir bool) (Ino, error) {
+	parent, name, err := t.walkParent(path)
+	if err != nil {
+		return Ino{}, err
+	}
+	a, ok := t.allocator.Reserve()
+	if !ok {
+		return Ino{}, errs.ErrNoSpace
+	}
+	// an all-zero header is an empty inode (and an empty directory)
+	t.d.Write(a, make(disk.Block, disk.BlockSize))
+	parent.m.Lock()
+	if parent.removed {
+		parent.m.Unlock()
+		t.allocator.Free(a)
+		return Ino{}, errs.ErrNotFound
+	}
+	_, exists := parent.entries[name]
+	if exists {
+		parent.m.Unlock()
+		t.allocator.Free(a)
+		return Ino{}, errs.ErrExists
+	}
+	gen := t.newGen()
+	err2 := parent.add(name, entry{addr: a, gen: gen, isDir: isDir, blk: 0}, t.allocator) // crash commit point
+	if err2 != nil {
+		parent.m.Unlock()
+		t.allocator.Free(a)
+		return Ino{}, err2
+	}
+	t.m.Lock()
+	if isDir {
+		t.dirs[a] = openDir(t.d, a, gen)
+	} else {
+		t.files[a] = newFile(t.d, a, gen)
+	}
+	t.m.Unlock()
+	parent.m.Unlock()
+	return Ino{Addr: a, Gen: gen, IsDir: isDir}, nil
+}
+
+// Mkdir creates an empty directory at path.
+//
+// Returns errs.ErrExists if path already exists, errs.ErrNotFound or
+// errs.ErrNotDir if its parent is not a directory, errs.ErrInvalidName for a
+// malformed path, or the inode errors errs.ErrNoSpace and errs.ErrInodeFull
+// (the parent has no room for another entry).
+func (t *Tree) Mkdir(path string) error {
+	_, err := t.create(path, true)
+	return err
+}
+
+// Create creates an empty file at path, failing like Mkdir.
+func (t *Tree) Create(path string) (Ino, error) {
+	return t.create(path, false)
+}
+
+// Rmdir removes the empty directory at path.
+//
+// Returns errs.ErrNotEmpty if the directory has entries, or errs.ErrNotDir if
+// path is a file. Removing a directory shadow-updates a block of its parent,
+// so it can also fail with errs.ErrNoSpace.
+func (t *Tree) Rmdir(path string) error {
+	parent, name, err := t.walkParent(path)
+	if err != nil {
+		return err
+	}
+	parent.m.Lock()
+	e, ok := parent.entries[name]
+	if !ok || parent.removed {
+		parent.m.Unlock()
+		return errs.ErrNotFound
+	}
+	if !e.isDir {
+		parent.m.Unlock()
+		return errs.ErrNotDir
+	}
+	child := t.getDir(e.addr)
+	child.m.Lock()
+	if len(child.entries) > 0 {
+		child.m.Unlock()
+		parent.m.Unlock()
+		return errs.ErrNotEmpty
+	}
+	err2 := parent.remove(name, t.allocator) // crash commit point
+	if err2 != nil {
+		child.m.Unlock()
+		parent.m.Unlock()
+		return err2
+	}
+	child.removed = true
+	t.m.Lock()
+	delete(t.dirs, e.addr)
+	t.m.Unlock()
+	child.m.Unlock()
+	parent.m.Unlock()
+	t.freeInode(e.addr, child.ino)
+	return nil
+}
+
+// Remove deletes the file at path and frees its blocks.
+//
+// Returns errs.ErrIsDir if path is a directory (use Rmdir), and otherwise
+// fails like Rmdir.
+func (t *Tree) Remove(path string) error {
+	parent, name, err := t.walkParent(path)
+	if err != nil {
+		return err
+	}
+	parent.m.Lock()
+	e, ok := parent.entries[name]
+	if !ok || parent.removed {
+		parent.m.Unlock()
+		return errs.ErrNotFound
+	}
+	if e.isDir {
+		parent.m.Unlock()
+		return errs.ErrIsDir
+	}
+	f := t.getFile(e.addr)
+	f.m.Lock()
+	err2 := parent.remove(name, t.allocator) // crash commit point
+	if err2 != nil {
+		f.m.Unlock()
+		parent.m.Unlock()
+		return err2
+	}
+	f.removed = true
+	t.m.Lock()
+	delete(t.files, e.addr)
+	t.m.Unlock()
+	f.m.Unlock()
+	parent.m.Unlock()
+	t.freeInode(e.addr, f.ino)
+	return nil
+}
+
+// Lookup returns the inode at path, such as /a/b/c.
+//
+// Returns errs.ErrNotFound if some name in path does not exist, or
+// errs.ErrNotDir if some component other than the last is a file.
+func (t *Tree) Lookup(path string) (Ino, error) {
+	names, err := splitPath(path)
+	if err != nil {
+		return Ino{}, err
+	}
+	if len(names) == 0 {
+		return Ino{Addr: rootAddr, Gen: t.root.gen, IsDir: true}, nil
+	}
+	parent, err := t.walk(names[:len(names)-1])
+	if err != nil {
+		return Ino{}, err
+	}
+	parent.m.Lock()
+	e, ok := parent.entries[names[len(names)-1]]
+	parent.m.Unlock()
+	if !ok {
+		return Ino{}, errs.ErrNotFound
+	}
+	return Ino{Addr: e.addr, Gen: e.gen, IsDir: e.isDir}, nil
+}
+
+// ReadDir lists the directory at path, sorted by name.
+func (t *Tree) ReadDir(path string) ([]DirEntry, error) {
+	names, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+	dn, err := t.walk(names)
+	if err != nil {
+		return nil, err
+	}
+	dn.m.Lock()
+	if dn.removed {
+		dn.m.Unlock()
+		return nil, errs.ErrNotFound
+	}
+	var ents []DirEntry
+	for name, e := range dn.entries {
+		ents = append(ents, DirEntry{Name: name, Ino: Ino{Addr: e.addr, Gen: e.gen, IsDir: e.isDir}})
+	}
+	dn.m.Unlock()
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name < ents[j].Name })
+	return ents, nil
+}
+
+// file returns the current file for ino
+//
+// Returns errs.ErrInvalidInode if ino is a stale handle to a removed file.
+func (t *Tree) file(ino Ino) (*fileNode, error) {
+	if ino.IsDir {
+		return nil, errs.ErrIsDir
+	}
+	f := t.getFile(ino.Addr)
+	if f == nil || f.gen != ino.Gen {
+		return nil, errs.ErrInvalidInode
+	}
+	return f, nil
+}
+
+// Read returns block off of file ino (nil if off is past the end).
+//
+// Returns errs.ErrInvalidInode if the file has been removed.
+func (t *Tree) Read(ino Ino, off uint64) (disk.Block, error) {
+	f, err := t.file(ino)
+	if err != nil {
+		return nil, err
+	}
+	// the file's blocks are freed once it is removed, so read under f.m
+	f.m.Lock()
+	if f.removed {
+		f.m.Unlock()
+		return nil, errs.ErrInvalidInode
+	}
+	b := f.ino.Read(off)
+	f.m.Unlock()
+	return b, nil
+}
+
+// Size returns the number of blocks in file ino, failing like Read.
+func (t *Tree) Size(ino Ino) (uint64, error) {
+	f, err := t.file(ino)
+	if err != nil {
+		return 0, err
+	}
+	f.m.Lock()
+	if f.removed {
+		f.m.Unlock()
+		return 0, errs.ErrInvalidInode
+	}
+	sz := f.ino.Size()
+	f.m.Unlock()
+	return sz, nil
+}
+
+// Append adds a block to file ino.
+//
+// Returns errs.ErrInvalidInode if the file has been removed, and otherwise
+// fails like inode.Inode.AppendErr.
+func (t *Tree) Append(ino Ino, b disk.Block) error {
+	f, err := t.file(ino)
+	if err != nil {
+		return err
+	}
+	f.m.Lock()
+	if f.removed {
+		f.m.Unlock()
+		return errs.ErrInvalidInode
+	}
+	err2 := f.ino.AppendErr(b, t.allocator)
+	f.m.Unlock()
+	return err2
+}
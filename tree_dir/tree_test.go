@@ -0,0 +1,315 @@
+package tree_dir
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/inode"
+)
+
+func makeBlock(x byte) disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	b[0] = x
+	return b
+}
+
+func names(ents []DirEntry) []string {
+	var ns []string
+	for _, e := range ents {
+		ns = append(ns, e.Name)
+	}
+	return ns
+}
+
+func TestTreeMkdirLookup(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1000)
+	tree := Open(theDisk, theDisk.Size())
+	assert.NoError(tree.Mkdir("/a"))
+	assert.NoError(tree.Mkdir("/a/b"))
+	assert.NoError(tree.Mkdir("/a/b/c"))
+	assert.NoError(tree.Mkdir("/a/d/"))
+
+	ino, err := tree.Lookup("/a/b/c")
+	assert.NoError(err)
+	assert.True(ino.IsDir)
+	root, _ := tree.Lookup("/")
+	assert.Equal(Ino{Addr: rootAddr, Gen: 0, IsDir: true}, root)
+
+	_, err = tree.Lookup("/a/x/c")
+	assert.Equal(errs.ErrNotFound, err)
+	assert.Equal(errs.ErrExists, tree.Mkdir("/a/b"))
+	assert.Equal(errs.ErrNotFound, tree.Mkdir("/x/y"))
+	assert.Equal(errs.ErrInvalidName, tree.Mkdir("a"))
+	assert.Equal(errs.ErrInvalidName, tree.Mkdir("/a/.."))
+	assert.Equal(errs.ErrInvalidName, tree.Mkdir("/"))
+
+	ents, err := tree.ReadDir("/a")
+	assert.NoError(err)
+	assert.Equal([]string{"b", "d"}, names(ents))
+}
+
+func TestTreeRmdir(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1000)
+	tree := Open(theDisk, theDisk.Size())
+	tree.Mkdir("/a")
+	tree.Mkdir("/a/b")
+	tree.Create("/a/f")
+	assert.Equal(errs.ErrNotEmpty, tree.Rmdir("/a"))
+	assert.Equal(errs.ErrNotDir, tree.Rmdir("/a/f"))
+	assert.Equal(errs.ErrIsDir, tree.Remove("/a/b"))
+	assert.NoError(tree.Rmdir("/a/b"))
+	assert.NoError(tree.Remove("/a/f"))
+	assert.NoError(tree.Rmdir("/a"))
+	assert.Equal(errs.ErrNotFound, tree.Rmdir("/a"))
+
+	ents, _ := tree.ReadDir("/")
+	assert.Len(ents, 0)
+	assert.NoError(tree.Mkdir("/a"), "should be able to reuse the name")
+}
+
+func TestTreeFiles(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1000)
+	tree := Open(theDisk, theDisk.Size())
+	tree.Mkdir("/a")
+	f, err := tree.Create("/a/f")
+	assert.NoError(err)
+	assert.False(f.IsDir)
+	assert.NoError(tree.Append(f, makeBlock(1)))
+	assert.NoError(tree.Append(f, makeBlock(2)))
+	sz, _ := tree.Size(f)
+	assert.Equal(uint64(2), sz)
+	b, _ := tree.Read(f, 1)
+	assert.Equal(makeBlock(2), b)
+
+	assert.Equal(errs.ErrNotDir, tree.Mkdir("/a/f/x"))
+	_, err = tree.ReadDir("/a/f")
+	assert.Equal(errs.ErrNotDir, err)
+	dir, _ := tree.Lookup("/a")
+	assert.Equal(errs.ErrIsDir, tree.Append(dir, makeBlock(1)))
+
+	tree.Remove("/a/f")
+	assert.Equal(errs.ErrInvalidInode, tree.Append(f, makeBlock(3)))
+}
+
+func TestTreeRecover(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1000)
+	tree := Open(theDisk, theDisk.Size())
+	tree.Mkdir("/a")
+	tree.Mkdir("/a/b")
+	tree.Mkdir("/c")
+	f, _ := tree.Create("/a/b/f")
+	tree.Append(f, makeBlock(7))
+	tree.Rmdir("/c")
+
+	tree = Open(theDisk, theDisk.Size())
+	ents, _ := tree.ReadDir("/")
+	assert.Equal([]string{"a"}, names(ents))
+	f2, err := tree.Lookup("/a/b/f")
+	assert.NoError(err)
+	assert.Equal(f, f2)
+	b, _ := tree.Read(f2, 0)
+	assert.Equal(makeBlock(7), b)
+}
+
+func TestTreeFreeSpace(t *testing.T) {
+	assert := assert.New(t)
+	// root, generation number, a block of entries in the root, and a file
+	// with one block
+	theDisk := disk.NewMemDisk(2 + 1 + 2)
+	tree := Open(theDisk, theDisk.Size())
+	for i := 0; i < 10; i++ {
+		f, err := tree.Create("/f")
+		assert.NoError(err, "removed files should be freed")
+		assert.NoError(tree.Append(f, makeBlock(byte(i))))
+		assert.NoError(tree.Remove("/f"))
+	}
+	// Open should also find the free space
+	tree = Open(theDisk, theDisk.Size())
+	f, err := tree.Create("/f")
+	assert.NoError(err)
+	assert.NoError(tree.Append(f, makeBlock(1)))
+	assert.Equal(errs.ErrNoSpace, tree.Mkdir("/d"))
+}
+
+func TestTreeChurn(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(100)
+	tree := Open(theDisk, theDisk.Size())
+	tree.Mkdir("/d")
+	tree.Create("/d/keep")
+	// many more changes than the directory inode has blocks
+	for i := uint64(0); i < 2*inode.MaxBlocks; i++ {
+		_, err := tree.Create("/d/f")
+		if !assert.NoError(err, "create %d", i) {
+			return
+		}
+		assert.NoError(tree.Remove("/d/f"))
+		assert.NoError(tree.Mkdir("/x"))
+		assert.NoError(tree.Rmdir("/x"))
+	}
+	assert.Equal(uint64(1), tree.getDir(rootAddr).ino.Size(),
+		"empty root should not use any blocks")
+	d, _ := tree.Lookup("/d")
+	assert.Equal(uint64(1), tree.getDir(d.Addr).ino.Size())
+
+	tree = Open(theDisk, theDisk.Size())
+	ents, _ := tree.ReadDir("/d")
+	assert.Equal([]string{"keep"}, names(ents))
+}
+
+func TestTreeManyEntries(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(1000)
+	tree := Open(theDisk, theDisk.Size())
+	long := strings.Repeat("x", int(MaxNameLen)-3)
+	for i := 0; i < 100; i++ {
+		_, err := tree.Create(fmt.Sprintf("/%s%03d", long, i))
+		assert.NoError(err)
+	}
+	assert.Greater(tree.root.ino.Size(), uint64(1), "entries should span blocks")
+	// removing from the middle rewrites a block, and the space is reused
+	for i := 0; i < 100; i += 2 {
+		assert.NoError(tree.Remove(fmt.Sprintf("/%s%03d", long, i)))
+	}
+	sz := tree.root.ino.Size()
+	for i := 0; i < 100; i += 2 {
+		_, err := tree.Create(fmt.Sprintf("/%s%03d", long, i))
+		assert.NoError(err)
+	}
+	assert.Equal(sz, tree.root.ino.Size())
+
+	tree = Open(theDisk, theDisk.Size())
+	ents, _ := tree.ReadDir("/")
+	assert.Len(ents, 100)
+	for i := 99; i >= 0; i-- {
+		assert.NoError(tree.Remove(fmt.Sprintf("/%s%03d", long, i)))
+	}
+	assert.Equal(uint64(0), tree.root.ino.Size(), "empty blocks should be truncated")
+}
+
+func TestTreeStaleHandle(t *testing.T) {
+	assert := assert.New(t)
+	// the only free blocks are for the file's header and the root's entries,
+	// so every file reuses one of the same two addresses
+	theDisk := disk.NewMemDisk(2 + 2)
+	tree := Open(theDisk, theDisk.Size())
+	old, err := tree.Create("/f")
+	assert.NoError(err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(tree.Remove("/f"))
+		f, err := tree.Create("/f")
+		assert.NoError(err)
+		assert.NotEqual(old.Gen, f.Gen)
+		_, err = tree.Size(old)
+		assert.Equal(errs.ErrInvalidInode, err, "stale handle should not refer to new file")
+		_, err = tree.Size(f)
+		assert.NoError(err)
+		old = f
+	}
+	// generations survive recovery
+	tree.Remove("/f")
+	tree = Open(theDisk, theDisk.Size())
+	f, _ := tree.Create("/f")
+	assert.Greater(f.Gen, old.Gen)
+}
+
+// pauseDisk blocks the first Read of addr until release is closed
+type pauseDisk struct {
+	disk.Disk
+	addr    uint64
+	once    sync.Once
+	paused  chan bool
+	release chan bool
+}
+
+func (d *pauseDisk) Read(a uint64) disk.Block {
+	if a == d.addr {
+		d.once.Do(func() {
+			close(d.paused)
+			<-d.release
+		})
+	}
+	return d.Disk.Read(a)
+}
+
+func TestTreeReadRemoved(t *testing.T) {
+	assert := assert.New(t)
+	// each file's header and data block reuse the blocks of the last one
+	theDisk := disk.NewMemDisk(2 + 3)
+	tree := Open(theDisk, theDisk.Size())
+	old, _ := tree.Create("/f")
+	assert.NoError(tree.Append(old, makeBlock(1)))
+	d := &pauseDisk{Disk: theDisk, addr: tree.getFile(old.Addr).ino.UsedBlocks()[0],
+		paused: make(chan bool), release: make(chan bool)}
+	tree = Open(d, d.Size())
+
+	readDone := make(chan disk.Block)
+	go func() {
+		b, err := tree.Read(old, 0)
+		if err != nil {
+			assert.Equal(errs.ErrInvalidInode, err)
+		}
+		readDone <- b
+	}()
+	<-d.paused
+	// the reader is in the middle of reading the old file's data block
+	writeDone := make(chan bool)
+	go func() {
+		assert.NoError(tree.Remove("/f"))
+		f, _ := tree.Create("/f")
+		assert.NoError(tree.Append(f, makeBlock(2)))
+		close(writeDone)
+	}()
+	select {
+	case <-writeDone:
+	case <-time.After(100 * time.Millisecond):
+		// Remove is waiting for the read to finish
+	}
+	close(d.release)
+	b := <-readDone
+	<-writeDone
+	if b != nil {
+		assert.Equal(byte(1), b[0], "stale handle read another file's data")
+	}
+}
+
+func TestTreeConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	theDisk := disk.NewMemDisk(10000)
+	tree := Open(theDisk, theDisk.Size())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			dir := fmt.Sprintf("/d%d", i)
+			tree.Mkdir(dir)
+			for j := 0; j < 20; j++ {
+				tree.Mkdir(fmt.Sprintf("%s/%d", dir, j))
+				// every thread also competes for a shared directory
+				tree.Mkdir(fmt.Sprintf("/shared-%d", j))
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	tree = Open(theDisk, theDisk.Size())
+	for i := 0; i < 4; i++ {
+		ents, err := tree.ReadDir(fmt.Sprintf("/d%d", i))
+		assert.NoError(err)
+		assert.Len(ents, 20)
+	}
+	ents, _ := tree.ReadDir("/")
+	assert.Len(ents, 4+20)
+}
@@ -0,0 +1,35 @@
+package txn
+
+import "sync"
+
+// lockMap provides a lock for every address, allocated on demand
+type lockMap struct {
+	m    *sync.Mutex
+	cond *sync.Cond
+	held map[uint64]bool
+}
+
+func newLockMap() *lockMap {
+	m := new(sync.Mutex)
+	return &lockMap{
+		m:    m,
+		cond: sync.NewCond(m),
+		held: make(map[uint64]bool),
+	}
+}
+
+func (lm *lockMap) Acquire(a uint64) {
+	lm.m.Lock()
+	for lm.held[a] {
+		lm.cond.Wait()
+	}
+	lm.held[a] = true
+	lm.m.Unlock()
+}
+
+func (lm *lockMap) Release(a uint64) {
+	lm.m.Lock()
+	delete(lm.held, a)
+	lm.cond.Broadcast()
+	lm.m.Unlock()
+}
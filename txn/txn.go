@@ -0,0 +1,161 @@
+// Transactional block store on top of the write-ahead log.
+//
+// A Txn buffers its writes in memory and commits them as a single atomic
+// wal.Log.Write. With locking enabled, a transaction holds a lock on every
+// address it reads or writes until it commits or aborts (two-phase locking),
+// which makes concurrent transactions serializable.
+package txn
+
+import (
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/wal"
+)
+
+type Store struct {
+	// read-only
+	log   *wal.Log
+	locks *lockMap // nil if locking is disabled
+}
+
+// Open creates a transactional store over log.
+//
+// If locking is set, transactions lock the addresses they access. Since locks
+// are acquired as addresses are accessed, concurrent transactions should
+// access addresses in a consistent order (for example, increasing) to avoid
+// deadlock.
+func Open(log *wal.Log, locking bool) *Store {
+	var locks *lockMap
+	if locking {
+		locks = newLockMap()
+	}
+	return &Store{log: log, locks: locks}
+}
+
+type Txn struct {
+	s      *Store
+	writes map[uint64]disk.Block
+	addrs  []uint64 // addresses in writes, in the order first written
+	locked []uint64 // addresses locked by this transaction
+	done   bool
+}
+
+// Begin starts a new transaction.
+func (s *Store) Begin() *Txn {
+	return &Txn{
+		s:      s,
+		writes: make(map[uint64]disk.Block),
+		addrs:  nil,
+		locked: nil,
+		done:   false,
+	}
+}
+
+func (t *Txn) isLocked(a uint64) bool {
+	var found = false
+	for _, la := range t.locked {
+		if la == a {
+			found = true
+		}
+	}
+	return found
+}
+
+// lock acquires the lock for a, if locking is enabled and t does not
+// already hold it
+func (t *Txn) lock(a uint64) {
+	if t.s.locks == nil {
+		return
+	}
+	if t.isLocked(a) {
+		return
+	}
+	t.s.locks.Acquire(a)
+	t.locked = append(t.locked, a)
+}
+
+func (t *Txn) releaseAll() {
+	if t.s.locks != nil {
+		for _, a := range t.locked {
+			t.s.locks.Release(a)
+		}
+	}
+	t.locked = nil
+	t.done = true
+}
+
+func copyBlock(b disk.Block) disk.Block {
+	b2 := make(disk.Block, len(b))
+	copy(b2, b)
+	return b2
+}
+
+// Read returns the contents of block a as seen by this transaction, including
+// its own buffered writes.
+//
+// The returned block is a copy; changing it does not change a buffered write.
+func (t *Txn) Read(a uint64) disk.Block {
+	if t.done {
+		panic("txn: use of finished transaction")
+	}
+	t.lock(a)
+	b, ok := t.writes[a]
+	if ok {
+		return copyBlock(b)
+	}
+	return t.s.log.Read(a)
+}
+
+// Write buffers a write of b to address a.
+//
+// The write is not visible to other transactions until Commit. The transaction
+// keeps its own copy of b, so the caller may reuse it once Write returns.
+func (t *Txn) Write(a uint64, b disk.Block) {
+	if t.done {
+		panic("txn: use of finished transaction")
+	}
+	t.lock(a)
+	_, ok := t.writes[a]
+	if !ok {
+		t.addrs = append(t.addrs, a)
+	}
+	t.writes[a] = copyBlock(b)
+}
+
+// CommitErr atomically and durably applies the transaction's writes.
+//
+// Returns the error from wal.Log.WriteErr if the log rejects the transaction
+// (for example, errs.ErrTxnTooLarge), in which case none of its writes are
+// applied. Either way the transaction is finished and its locks are released.
+func (t *Txn) CommitErr() error {
+	if t.done {
+		panic("txn: use of finished transaction")
+	}
+	var upds []wal.Update
+	for _, a := range t.addrs {
+		upds = append(upds, wal.Update{Addr: a, Block: t.writes[a]})
+	}
+	var err error
+	if len(upds) > 0 {
+		err = t.s.log.WriteErr(upds)
+	}
+	t.releaseAll()
+	return err
+}
+
+// Commit atomically and durably applies the transaction's writes.
+//
+// Returns false if the log rejects the transaction, like CommitErr.
+func (t *Txn) Commit() bool {
+	return t.CommitErr() == nil
+}
+
+// Abort drops the transaction's writes and releases its locks.
+func (t *Txn) Abort() {
+	if t.done {
+		panic("txn: use of finished transaction")
+	}
+	t.writes = nil
+	t.addrs = nil
+	t.releaseAll()
+}
@@ -0,0 +1,145 @@
+package txn
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine"
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/wal"
+)
+
+func mkBlock(b0 byte) disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	b[0] = b0
+	return b
+}
+
+func TestTxnCommit(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	s := Open(wal.Open(d), false)
+	txn := s.Begin()
+	txn.Write(600, mkBlock(1))
+	txn.Write(601, mkBlock(2))
+	txn.Write(600, mkBlock(3))
+	assert.Equal(byte(3), txn.Read(600)[0], "should read own writes")
+	assert.Equal(byte(0), s.Begin().Read(600)[0],
+		"writes should not be visible before commit")
+	assert.True(txn.Commit())
+
+	txn = s.Begin()
+	assert.Equal(byte(3), txn.Read(600)[0])
+	assert.Equal(byte(2), txn.Read(601)[0])
+	txn.Abort()
+}
+
+func TestTxnAbort(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	s := Open(wal.Open(d), true)
+	txn := s.Begin()
+	txn.Write(600, mkBlock(1))
+	txn.Abort()
+
+	txn = s.Begin()
+	assert.Equal(byte(0), txn.Read(600)[0], "aborted write should be dropped")
+	txn.Commit()
+}
+
+func TestTxnCopy(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	s := Open(wal.Open(d), false)
+	txn := s.Begin()
+	b := mkBlock(1)
+	txn.Write(600, b)
+	b[0] = 2
+	txn.Write(601, b)
+	b[0] = 3
+	txn.Read(600)[0] = 4
+	assert.True(txn.Commit())
+
+	txn = s.Begin()
+	assert.Equal(byte(1), txn.Read(600)[0], "reusing a buffer should not change a write")
+	assert.Equal(byte(2), txn.Read(601)[0])
+	txn.Abort()
+}
+
+func TestTxnCommitErr(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(2000)
+	s := Open(wal.Open(d), false)
+	txn := s.Begin()
+	for a := uint64(1000); a < 2000; a++ {
+		txn.Write(a, mkBlock(1))
+	}
+	assert.Equal(errs.ErrTxnTooLarge, txn.CommitErr())
+
+	txn = s.Begin()
+	txn.Write(1, mkBlock(1))
+	assert.Equal(wal.ErrInvalidAddr, txn.CommitErr())
+
+	txn = s.Begin()
+	assert.Equal(byte(0), txn.Read(1000)[0], "failed commit should not apply writes")
+	txn.Write(1000, mkBlock(2))
+	assert.NoError(txn.CommitErr())
+}
+
+func TestTxnRecover(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := wal.Open(d)
+	s := Open(log, false)
+	txn := s.Begin()
+	txn.Write(600, mkBlock(1))
+	txn.Write(700, mkBlock(2))
+	txn.Commit()
+	log.Close()
+
+	s = Open(wal.Open(d), false)
+	txn = s.Begin()
+	assert.Equal(byte(1), txn.Read(600)[0])
+	assert.Equal(byte(2), txn.Read(700)[0])
+	txn.Abort()
+}
+
+func readCounter(txn *Txn, a uint64) uint64 {
+	return machine.UInt64Get(txn.Read(a))
+}
+
+func writeCounter(txn *Txn, a uint64, x uint64) {
+	b := make(disk.Block, disk.BlockSize)
+	machine.UInt64Put(b, x)
+	txn.Write(a, b)
+}
+
+func TestTxnSerializable(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	s := Open(wal.Open(d), true)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			for j := 0; j < 25; j++ {
+				// update both counters, accessing addresses in order
+				txn := s.Begin()
+				x := readCounter(txn, 600)
+				y := readCounter(txn, 601)
+				writeCounter(txn, 600, x+1)
+				writeCounter(txn, 601, y+2)
+				txn.Commit()
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	txn := s.Begin()
+	assert.Equal(uint64(8*25), readCounter(txn, 600), "no lost updates")
+	assert.Equal(uint64(2*8*25), readCounter(txn, 601), "no lost updates")
+	txn.Abort()
+}
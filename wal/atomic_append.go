@@ -1,74 +1,308 @@
-// Append-only, sequential, crash-safe log.
+// Append-only, sequential, crash-safe circular log.
 //
 // The main interesting feature is that the log supports multi-block atomic
 // appends, which are implemented by atomically updating an on-disk header with
-// the number of valid blocks in the log.
+// the end of the valid region of the log. The beginning of the log is
+// similarly truncated by updating the start pointer in the header, so space at
+// the front of the log can be reused without disturbing the rest of it.
+//
+// The addresses of logged updates are stored in descriptor blocks inside the
+// log rather than in the header, so the size of an append is limited only by
+// the size of the log, while the header still fits in (and commits with) a
+// single block write.
+//
+// The header and every block in the log are checksummed, so recovery can
+// detect a corrupted log rather than replaying garbage over the data.
 package wal
 
 import (
+	"fmt"
+	"hash/crc64"
+
 	"github.com/tchajed/marshal"
 
 	"github.com/tchajed/goose/machine/disk"
 )
 
-const maxLogSize uint64 = 511
+// on-disk layout of the log, starting at hdrAddr:
+// [ header | log blocks: [size]Block ]
+//
+// header:
+// [ magic: u64 | version: u64 | start: u64 | end: u64 | ... |
+//   hdrChecksum: u64 ]
+//
+// start and end are logical positions that only increase; position p is
+// stored in log block p % size. The valid part of the log, [start, end), is a
+// sequence of records, each of which is a descriptor block followed by the
+// data blocks it describes.
+//
+// descriptor:
+// [ descMagic: u64 | pos: u64 | n: u64 |
+//   entries: [n]{ addr: u64 | checksum: u64 } | ... | descChecksum: u64 ]
+//
+// pos is the position of the descriptor itself, which catches stale blocks
+// left over from an earlier trip around the log. Each entry records the home
+// address of an update and the checksum of its data block. The checksums at the
+// end of the header and descriptor cover everything before them.
+//
+// An all-zero header is an empty log, so a freshly zeroed disk is a valid log.
+
+const logMagic uint64 = 0x706572656e77616c // "perenwal"
+
+const logVersion uint64 = 2
+
+const descMagic uint64 = 0x7761646573637231 // "wadescr1"
+
+// Maximum number of updates described by one descriptor block.
+const descMaxUpdates uint64 = (disk.BlockSize - 4*8) / 16
 
-type update struct {
-	addr uint64
-	b    disk.Block
+// CorruptError reports a log that failed verification during recovery.
+type CorruptError struct {
+	Addr   uint64 // disk address of the block that failed verification
+	Reason string
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("wal: corrupt log at block %d: %s", e.Addr, e.Reason)
+}
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+func checksum(b []byte) uint64 {
+	return crc64.Checksum(b, crcTable)
+}
+
+// sealBlock stores a checksum of the rest of b in its last 8 bytes
+func sealBlock(b disk.Block) {
+	sum := checksum(b[:disk.BlockSize-8])
+	marshal.NewEncFromSlice(b[disk.BlockSize-8:]).PutInt(sum)
+}
+
+// checkSeal verifies the checksum stored by sealBlock
+func checkSeal(b disk.Block) bool {
+	sum := marshal.NewDec(b[disk.BlockSize-8:]).GetInt()
+	return sum == checksum(b[:disk.BlockSize-8])
+}
+
+// logCapacity returns the number of updates that fit in size log blocks,
+// accounting for descriptors
+func logCapacity(size uint64) uint64 {
+	fullRecords := size / (1 + descMaxUpdates)
+	rest := size % (1 + descMaxUpdates)
+	if rest <= 1 {
+		return fullRecords * descMaxUpdates
+	}
+	return fullRecords*descMaxUpdates + (rest - 1)
 }
 
 type appender struct {
-	d     disk.Disk
-	addrs []uint64
+	// read-only
+	d       disk.Disk
+	hdrAddr uint64
+	size    uint64
+
+	start uint64
+	end   uint64
 }
 
 func (app *appender) mkHdr() disk.Block {
 	enc := marshal.NewEnc(disk.BlockSize)
-	enc.PutInt(uint64(len(app.addrs)))
-	enc.PutInts(app.addrs)
-	return enc.Finish()
+	enc.PutInt(logMagic)
+	enc.PutInt(logVersion)
+	enc.PutInt(app.start)
+	enc.PutInt(app.end)
+	hdr := enc.Finish()
+	sealBlock(hdr)
+	return hdr
 }
 
 func (app *appender) writeHdr() {
-	app.d.Write(0, app.mkHdr())
+	app.d.Write(app.hdrAddr, app.mkHdr())
+}
+
+// logBlock gives the disk address where log position pos is stored
+func (app *appender) logBlock(pos uint64) uint64 {
+	return app.hdrAddr + 1 + pos%app.size
 }
 
-func openAppender(d disk.Disk) (*appender, []update) {
-	hdr := d.Read(0)
+func isZero(b disk.Block) bool {
+	var zero = true
+	for _, x := range b {
+		if x != 0 {
+			zero = false
+		}
+	}
+	return zero
+}
+
+// parseHdr decodes and verifies the header stored at hdrAddr
+func parseHdr(hdr disk.Block, hdrAddr uint64, size uint64) (*appender, error) {
+	if isZero(hdr) {
+		return &appender{hdrAddr: hdrAddr, size: size}, nil
+	}
 	dec := marshal.NewDec(hdr)
-	sz := dec.GetInt()
-	addrs := dec.GetInts(sz)
-	var upds = make([]update, 0)
-	for i, addr := range addrs {
-		upds = append(upds, update{
-			addr: addr,
-			b:    d.Read(1 + uint64(i)),
-		})
+	magic := dec.GetInt()
+	if magic != logMagic {
+		return nil, &CorruptError{Addr: hdrAddr, Reason: "bad magic number"}
 	}
-	return &appender{d: d, addrs: addrs}, upds
+	version := dec.GetInt()
+	if version != logVersion {
+		return nil, &CorruptError{Addr: hdrAddr,
+			Reason: fmt.Sprintf("unsupported version %d", version)}
+	}
+	if !checkSeal(hdr) {
+		return nil, &CorruptError{Addr: hdrAddr, Reason: "header checksum mismatch"}
+	}
+	start := dec.GetInt()
+	end := dec.GetInt()
+	if end < start || end-start > size {
+		return nil, &CorruptError{Addr: hdrAddr,
+			Reason: fmt.Sprintf("invalid log bounds [%d, %d)", start, end)}
+	}
+	return &appender{
+		hdrAddr: hdrAddr,
+		size:    size,
+		start:   start,
+		end:     end,
+	}, nil
+}
+
+func mkDesc(pos uint64, upds []Update) disk.Block {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(descMagic)
+	enc.PutInt(pos)
+	enc.PutInt(uint64(len(upds)))
+	for _, u := range upds {
+		enc.PutInt(u.Addr)
+		enc.PutInt(checksum(u.Block))
+	}
+	desc := enc.Finish()
+	sealBlock(desc)
+	return desc
+}
+
+// readRecord reads and verifies the record whose descriptor is at position
+// pos, where the valid log ends at end
+//
+// Returns the updates in the record.
+func (app *appender) readRecord(pos uint64, end uint64) ([]Update, error) {
+	descAddr := app.logBlock(pos)
+	desc := app.d.Read(descAddr)
+	if !checkSeal(desc) {
+		return nil, &CorruptError{Addr: descAddr, Reason: "descriptor checksum mismatch"}
+	}
+	dec := marshal.NewDec(desc)
+	magic := dec.GetInt()
+	descPos := dec.GetInt()
+	n := dec.GetInt()
+	if magic != descMagic || descPos != pos {
+		return nil, &CorruptError{Addr: descAddr, Reason: "bad descriptor"}
+	}
+	if n == 0 || n > descMaxUpdates || n > end-pos-1 {
+		return nil, &CorruptError{Addr: descAddr,
+			Reason: fmt.Sprintf("invalid descriptor size %d", n)}
+	}
+	var upds = make([]Update, 0)
+	for i := uint64(0); i < n; i++ {
+		addr := dec.GetInt()
+		sum := dec.GetInt()
+		a := app.logBlock(pos + 1 + i)
+		b := app.d.Read(a)
+		if checksum(b) != sum {
+			return nil, &CorruptError{Addr: a, Reason: "block checksum mismatch"}
+		}
+		upds = append(upds, Update{Addr: addr, Block: b})
+	}
+	return upds, nil
 }
 
-func writeAll(d disk.Disk, upds []update, off uint64) {
+// readLog reads and verifies the log stored at hdrAddr, with size log blocks
+//
+// Returns every logged update, in order, along with where it is stored.
+func readLog(d disk.Disk, hdrAddr uint64, size uint64) (*appender, []Entry, error) {
+	app, err := parseHdr(d.Read(hdrAddr), hdrAddr, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	app.d = d
+	var entries = make([]Entry, 0)
+	var pos = app.start
+	for pos < app.end {
+		record, err := app.readRecord(pos, app.end)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, u := range record {
+			dataPos := pos + 1 + uint64(i)
+			entries = append(entries, Entry{
+				Pos:     dataPos,
+				LogAddr: app.logBlock(dataPos),
+				Update:  u,
+			})
+		}
+		pos = pos + 1 + uint64(len(record))
+	}
+	return app, entries, nil
+}
+
+// openAppender recovers the log stored at hdrAddr, with size log blocks
+//
+// Returns a *CorruptError if the header or any logged block fails
+// verification, in which case nothing should be replayed.
+func openAppender(d disk.Disk, hdrAddr uint64, size uint64) (*appender, []Update, error) {
+	app, entries, err := readLog(d, hdrAddr, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	var upds = make([]Update, 0)
+	for _, e := range entries {
+		upds = append(upds, e.Update)
+	}
+	return app, upds, nil
+}
+
+// Free returns the number of updates that can be appended without truncating
+func (app *appender) Free() uint64 {
+	return logCapacity(app.size - (app.end - app.start))
+}
+
+// writeRecord writes a descriptor and data blocks for upds at position pos
+//
+// Requires 0 < len(upds) <= descMaxUpdates.
+func (app *appender) writeRecord(upds []Update, pos uint64) {
+	app.d.Write(app.logBlock(pos), mkDesc(pos, upds))
 	for i, u := range upds {
-		d.Write(off+uint64(i), u.b)
+		app.d.Write(app.logBlock(pos+1+uint64(i)), u.Block)
 	}
 }
 
-func (app *appender) Append(upds []update) bool {
-	sz := uint64(len(app.addrs))
-	if sz+uint64(len(upds)) > maxLogSize {
+func (app *appender) Append(upds []Update) bool {
+	if uint64(len(upds)) > app.Free() {
 		return false
 	}
-	writeAll(app.d, upds, 1+sz)
-	for _, u := range upds {
-		app.addrs = append(app.addrs, u.addr)
+	var pos = app.end
+	var rest = upds
+	for uint64(len(rest)) > 0 {
+		n := uint64(len(rest))
+		if n > descMaxUpdates {
+			n = descMaxUpdates
+		}
+		app.writeRecord(rest[:n], pos)
+		pos = pos + 1 + n
+		rest = rest[n:]
 	}
+	// commit point: every record becomes part of the log at once
+	app.end = pos
 	app.writeHdr()
 	return true
 }
 
-func (app *appender) Reset() {
-	app.addrs = nil
+// Truncate drops the records before position newStart from the log
+//
+// Requires start <= newStart <= end, and newStart should be the position of a
+// record boundary. The caller is responsible for having installed the dropped
+// updates, since they will no longer be replayed on recovery.
+func (app *appender) Truncate(newStart uint64) {
+	app.start = newStart
 	app.writeHdr()
 }
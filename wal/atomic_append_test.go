@@ -15,38 +15,124 @@ func mkBlock(b0 byte) disk.Block {
 
 func TestAppender_Append(t *testing.T) {
 	d := disk.NewMemDisk(1000)
-	app, _ := openAppender(d)
-	upds1 := []update{
-		{addr: 3, b: mkBlock(1)},
-		{addr: 2, b: mkBlock(2)},
+	app, _, _ := openAppender(d, 0, defaultLogSize)
+	upds1 := []Update{
+		{Addr: 3, Block: mkBlock(1)},
+		{Addr: 2, Block: mkBlock(2)},
 	}
-	upds2 := []update{
-		{addr: 7, b: mkBlock(3)},
-		{addr: 9, b: mkBlock(4)},
+	upds2 := []Update{
+		{Addr: 7, Block: mkBlock(3)},
+		{Addr: 9, Block: mkBlock(4)},
 	}
 	app.Append(upds1)
 	app.Append(upds2)
-	app, upds := openAppender(d)
-	expected := append(append([]update{}, upds1...), upds2...)
+	app, upds, _ := openAppender(d, 0, defaultLogSize)
+	expected := append(append([]Update{}, upds1...), upds2...)
 	assert.Equal(t, expected, upds)
 }
 
-func TestAppender_Reset(t *testing.T) {
+func TestAppender_Truncate(t *testing.T) {
 	d := disk.NewMemDisk(1000)
-	app, _ := openAppender(d)
-	upds1 := []update{
-		{addr: 3, b: mkBlock(1)},
-		{addr: 2, b: mkBlock(2)},
+	app, _, _ := openAppender(d, 0, defaultLogSize)
+	upds1 := []Update{
+		{Addr: 3, Block: mkBlock(1)},
+		{Addr: 2, Block: mkBlock(2)},
 	}
-	upds2 := []update{
-		{addr: 7, b: mkBlock(3)},
-		{addr: 9, b: mkBlock(4)},
+	upds2 := []Update{
+		{Addr: 7, Block: mkBlock(3)},
+		{Addr: 9, Block: mkBlock(4)},
 	}
 	app.Append(upds1)
-	app.Reset()
-	app, upds := openAppender(d)
-	assert.Equal(t, []update{}, upds)
+	app.Truncate(app.end)
+	app, upds, _ := openAppender(d, 0, defaultLogSize)
+	assert.Equal(t, []Update{}, upds)
 	app.Append(upds2)
-	app, upds = openAppender(d)
-	assert.Equal(t, upds2, upds)
+	mid := app.end
+	app.Append(upds1)
+	app.Truncate(mid)
+	app, upds, _ = openAppender(d, 0, defaultLogSize)
+	assert.Equal(t, upds1, upds)
+}
+
+func TestAppender_WrapAround(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	app, _, _ := openAppender(d, 0, defaultLogSize)
+	var upds1 []Update
+	for i := uint64(0); i < logCapacity(defaultLogSize)-1; i++ {
+		upds1 = append(upds1, Update{Addr: 600 + i, Block: mkBlock(1)})
+	}
+	assert.True(app.Append(upds1))
+	upds2 := []Update{
+		{Addr: 7, Block: mkBlock(3)},
+		{Addr: 9, Block: mkBlock(4)},
+	}
+	assert.False(app.Append(upds2), "log should be full")
+	app.Truncate(app.end)
+	assert.True(app.Append(upds2), "log should have space after truncate")
+	_, upds, _ := openAppender(d, 0, defaultLogSize)
+	assert.Equal(upds2, upds)
+}
+
+func TestAppender_Corrupt(t *testing.T) {
+	assert := assert.New(t)
+	upds := []Update{
+		{Addr: 3, Block: mkBlock(1)},
+		{Addr: 2, Block: mkBlock(2)},
+	}
+
+	// corrupt logged block
+	d := disk.NewMemDisk(1000)
+	app, _, _ := openAppender(d, 0, defaultLogSize)
+	app.Append(upds)
+	d.Write(app.logBlock(app.start+1), mkBlock(7))
+	_, _, err := openAppender(d, 0, defaultLogSize)
+	assert.Equal(&CorruptError{Addr: 2, Reason: "block checksum mismatch"}, err)
+
+	// corrupt descriptor
+	d = disk.NewMemDisk(1000)
+	app, _, _ = openAppender(d, 0, defaultLogSize)
+	app.Append(upds)
+	d.Write(app.logBlock(app.start), mkBlock(7))
+	_, _, err = openAppender(d, 0, defaultLogSize)
+	assert.Equal(&CorruptError{Addr: 1, Reason: "descriptor checksum mismatch"}, err)
+
+	// corrupt header contents
+	d = disk.NewMemDisk(1000)
+	app, _, _ = openAppender(d, 0, defaultLogSize)
+	app.Append(upds)
+	hdr := d.Read(0)
+	hdr[40] ^= 1
+	d.Write(0, hdr)
+	_, _, err = openAppender(d, 0, defaultLogSize)
+	assert.Equal(&CorruptError{Addr: 0, Reason: "header checksum mismatch"}, err)
+
+	// garbage header
+	d = disk.NewMemDisk(1000)
+	d.Write(0, mkBlock(1))
+	_, _, err = openAppender(d, 0, defaultLogSize)
+	assert.Equal(&CorruptError{Addr: 0, Reason: "bad magic number"}, err)
+}
+
+func TestAppender_Large(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(5000)
+	app, _, _ := openAppender(d, 0, 2500)
+	var upds []Update
+	for i := uint64(0); i < 2000; i++ {
+		upds = append(upds, Update{Addr: 3000 + i, Block: mkBlock(byte(i))})
+	}
+	assert.True(app.Append(upds), "large append should fit in the log")
+	_, recovered, err := openAppender(d, 0, 2500)
+	assert.NoError(err)
+	assert.Equal(upds, recovered)
+}
+
+func TestLogCapacity(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(uint64(0), logCapacity(1))
+	assert.Equal(uint64(1), logCapacity(2))
+	assert.Equal(descMaxUpdates, logCapacity(descMaxUpdates+1))
+	assert.Equal(descMaxUpdates, logCapacity(descMaxUpdates+2))
+	assert.Equal(descMaxUpdates+1, logCapacity(descMaxUpdates+3))
 }
@@ -0,0 +1,69 @@
+//go:build !windows
+// +build !windows
+
+package wal
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tchajed/goose/machine/disk"
+)
+
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// BenchmarkLogIdle measures the CPU time used by an idle log (and a writer
+// blocked waiting for durability of a transaction), per second of wall-clock
+// time.
+func BenchmarkLogIdle(b *testing.B) {
+	d := disk.NewMemDisk(1000)
+	log := Open(d)
+	log.Write([]Update{mkUpdate(602, 1)})
+	// a writer that never finishes, since nothing will log its transaction
+	d2 := disk.NewMemDisk(1000)
+	l, _, _ := open(d2, d2, DefaultOptions(d2))
+	go l.writeWait(1)
+
+	const idle = 10 * time.Millisecond
+	b.ResetTimer()
+	start := cpuTime()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(idle)
+	}
+	used := cpuTime() - start
+	b.ReportMetric(float64(used)/float64(idle*time.Duration(b.N)), "cpu/wall")
+	log.Close()
+}
+
+func BenchmarkLogWrite(b *testing.B) {
+	d := disk.NewMemDisk(1000)
+	log := Open(d)
+	upds := []Update{mkUpdate(600, 1), mkUpdate(601, 2)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		log.Write(upds)
+	}
+	log.Close()
+}
+
+func BenchmarkLogConcurrentWrite(b *testing.B) {
+	d := disk.NewMemDisk(1000)
+	opts := DefaultOptions(d)
+	opts.Batch = BatchPolicy{MaxBatch: 32, MaxWait: time.Millisecond}
+	log, _ := OpenWithOptions(d, opts)
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		upds := []Update{mkUpdate(600, 1)}
+		for pb.Next() {
+			log.Write(upds)
+		}
+	})
+	b.ReportMetric(log.Stats().AvgBatchSize(), "txns/batch")
+	log.Close()
+}
@@ -0,0 +1,44 @@
+package wal
+
+import (
+	"fmt"
+
+	"github.com/tchajed/goose/machine/disk"
+)
+
+// Entry is an update as stored in the log.
+type Entry struct {
+	Pos     uint64 // logical position in the log
+	LogAddr uint64 // disk address of the logged copy of the block
+	Update
+}
+
+// LogState describes the contents of a log on disk, as recovery would see it.
+type LogState struct {
+	HdrAddr uint64
+	Start   uint64
+	End     uint64
+	// logged updates, in the order recovery would replay them
+	Entries []Entry
+}
+
+// Inspect reads the log on logDisk described by opts without modifying
+// anything, for debugging.
+//
+// Returns a *CorruptError if recovery would refuse to replay the log.
+func Inspect(logDisk disk.Disk, opts Options) (*LogState, error) {
+	if opts.LogSize == 0 || opts.logEnd() > logDisk.Size() {
+		return nil, fmt.Errorf("%w: log [%d, %d) does not fit on disk of size %d",
+			ErrInvalidLayout, opts.LogStart, opts.logEnd(), logDisk.Size())
+	}
+	app, entries, err := readLog(logDisk, opts.LogStart, opts.LogSize)
+	if err != nil {
+		return nil, err
+	}
+	return &LogState{
+		HdrAddr: app.hdrAddr,
+		Start:   app.start,
+		End:     app.end,
+		Entries: entries,
+	}, nil
+}
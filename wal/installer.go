@@ -0,0 +1,53 @@
+package wal
+
+import "github.com/tchajed/goose/machine/disk"
+
+// installBatch is a group of logged updates that has not been installed yet
+type installBatch struct {
+	upds []Update
+	// log position just past the batch; once the batch is installed, the log
+	// can be truncated up to here
+	end uint64
+}
+
+// install writes txn to its home locations
+//
+// Readers do not observe these writes piecemeal: txn stays in the install
+// queue until install finishes, and Read serves addresses in the queue from
+// memory.
+func install(d disk.Disk, txn []Update) {
+	for _, u := range txn {
+		d.Write(u.Addr, u.Block)
+	}
+}
+
+// installer installs logged batches in order, running concurrently with the
+// logger so that logging the next batch overlaps with installing this one.
+//
+// The installer never touches the on-disk log; it only advances
+// l.installedPos, and the logger truncates the log up to there when it needs
+// space.
+func (l *Log) installer() {
+	l.m.Lock()
+	for {
+		for uint64(len(l.installQueue)) == 0 && !l.loggerDone {
+			l.condInstall.Wait()
+		}
+		if uint64(len(l.installQueue)) == 0 {
+			// the logger has exited and everything is installed
+			break
+		}
+		batch := l.installQueue[0]
+		l.m.Unlock()
+
+		install(l.d, batch.upds)
+
+		l.m.Lock()
+		l.installQueue = l.installQueue[1:]
+		l.installedPos = batch.end
+		l.condInstalled.Broadcast()
+	}
+	l.installerDone = true
+	l.condShut.Broadcast()
+	l.m.Unlock()
+}
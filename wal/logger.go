@@ -1,53 +1,70 @@
 package wal
 
-import "github.com/tchajed/goose/machine/disk"
+import "time"
 
-func install(d disk.Disk, txn []update) {
-	// TODO: we need threads to either not observe these writes or see them
-	//  all atomically. Not observing them is hard,
-	//  since we don't have the old values.
-	//  Committing them requires that we atomically write the header and
-	//  cause threads to start reading from the wal,
-	//  which we can do with a reverse search in the wal.
-	//  This means we should prepare the wal, _lock_,
-	//  and then write the header, which breaks the atomic_append API.
-	for _, u := range txn {
-		d.Write(u.addr, u.b)
+// Stats counts the commits made by the logger.
+type Stats struct {
+	Batches uint64 // number of group commits
+	Txns    uint64 // number of transactions committed
+	Updates uint64 // number of updates committed, before absorption
+}
+
+// AvgBatchSize returns the average number of transactions per group commit.
+func (s Stats) AvgBatchSize() float64 {
+	if s.Batches == 0 {
+		return 0
 	}
+	return float64(s.Txns) / float64(s.Batches)
 }
 
-func absorb(txn []update) []update {
+func absorb(txn []Update) []Update {
 	addrs := make(map[uint64]uint64)
-	var absorbed []update
+	var absorbed []Update
 	for _, u := range txn {
-		i, ok := addrs[u.addr]
+		i, ok := addrs[u.Addr]
 		if ok {
-			absorbed[i].b = u.b
+			absorbed[i].Block = u.Block
 		} else {
 			newIndex := uint64(len(absorbed))
-			addrs[u.addr] = newIndex
+			addrs[u.Addr] = newIndex
 			absorbed = append(absorbed, u)
 		}
 	}
 	return absorbed
 }
 
-// logOne takes the current pending transaction and logs and installs it
+// logOne takes the current pending transactions and logs them
+//
+// Once logged, the transactions are durable, and they are handed off to the
+// installer.
 //
 // Assumes lock is held initially.
-func (l *Log) logAndInstallOne(app *appender) {
+func (l *Log) logOne(app *appender) {
 	txn := l.pending
 	if uint64(len(txn)) == 0 {
 		return
 	}
+	numTxns := l.pendingTxns
 	l.m.Unlock()
 
 	absorbed := absorb(txn)
+
+	l.m.Lock()
+	// wait for the installer to make room; log space is only reclaimed after
+	// installation
+	for logCapacity(app.size-(app.end-l.installedPos)) < uint64(len(absorbed)) {
+		l.condInstalled.Wait()
+	}
+	installedPos := l.installedPos
+	l.m.Unlock()
+
+	if uint64(len(absorbed)) > app.Free() {
+		// everything before installedPos has been installed, so we can
+		// reclaim it
+		app.Truncate(installedPos)
+	}
 	app.Append(absorbed)
 	// now txn (via absorbed) is durable
-	install(l.d, absorbed)
-	app.Reset()
-	// and now it's fully installed
 
 	l.m.Lock()
 	// note that there might be new pending transactions which we missed
@@ -55,15 +72,76 @@ func (l *Log) logAndInstallOne(app *appender) {
 	//  we really need it? can it be a transaction count?
 	l.diskEnd = l.diskEnd + uint64(len(txn))
 	l.pending = l.pending[len(txn):]
+	l.pendingTxns = l.pendingTxns - numTxns
+	// hand off to the installer; until it is installed, reads are served
+	// from the install queue
+	l.installQueue = append(l.installQueue, installBatch{upds: absorbed, end: app.end})
+	l.stats.Batches = l.stats.Batches + 1
+	l.stats.Txns = l.stats.Txns + numTxns
+	l.stats.Updates = l.stats.Updates + uint64(len(txn))
+	l.condInstall.Broadcast()
+	l.condSpace.Broadcast()
+	l.condDurable.Broadcast()
 	// once we unlock, then other threads will know that txn is durable
 }
 
+// batchReady determines whether the logger should commit l.pending now,
+// according to the batching policy
+//
+// Requires the lock to be held.
+func (l *Log) batchReady(deadline time.Time) bool {
+	p := l.opts.Batch
+	if l.shutdown {
+		return true
+	}
+	if p.MaxBatch > 0 && uint64(len(l.pending)) >= p.MaxBatch {
+		return true
+	}
+	if p.CommitIfWaiting && l.waiters > 0 {
+		return true
+	}
+	// waiting longer cannot grow the batch if writers are blocked on space
+	if l.spaceWaiters > 0 {
+		return true
+	}
+	return !time.Now().Before(deadline)
+}
+
+// waitForBatch waits until the batching policy says to commit
+//
+// Requires the lock to be held (and keeps it held on return).
+func (l *Log) waitForBatch() {
+	deadline := time.Now().Add(l.opts.Batch.MaxWait)
+	if l.batchReady(deadline) {
+		return
+	}
+	timer := time.AfterFunc(l.opts.Batch.MaxWait, func() {
+		l.m.Lock()
+		l.condLogger.Broadcast()
+		l.m.Unlock()
+	})
+	for !l.batchReady(deadline) {
+		l.condLogger.Wait()
+	}
+	timer.Stop()
+}
+
 func (l *Log) logger(app *appender) {
 	l.m.Lock()
 	for {
-		l.logAndInstallOne(app)
-		// TODO: replace with cond var
-		l.m.Unlock()
-		l.m.Lock()
+		for uint64(len(l.pending)) == 0 && !l.shutdown {
+			l.condLogger.Wait()
+		}
+		if uint64(len(l.pending)) == 0 {
+			// shut down and fully drained
+			break
+		}
+		l.waitForBatch()
+		l.logOne(app)
 	}
+	l.loggerDone = true
+	// the installer exits once it sees the logger is done
+	l.condInstall.Broadcast()
+	l.condShut.Broadcast()
+	l.m.Unlock()
 }
@@ -0,0 +1,130 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tchajed/goose/machine/disk"
+)
+
+// ErrInvalidLayout is returned by OpenWithOptions when the requested layout
+// does not fit on the disk or would let transactions overwrite the log.
+var ErrInvalidLayout = errors.New("wal: invalid layout")
+
+// Options describes where a Log lives on disk.
+//
+// The log occupies LogSize+1 blocks starting at LogStart (a header followed by
+// the log blocks). Transactions may only write to the DataSize blocks starting
+// at DataStart, which must not overlap the log if the log and data share a
+// disk.
+//
+// The log region must be the same every time a log is opened, since the
+// header does not record it. A transaction can have at most as many updates as
+// fit in the log, which is a little less than LogSize since the log also
+// stores descriptor blocks.
+type Options struct {
+	LogStart  uint64
+	LogSize   uint64
+	DataStart uint64
+	DataSize  uint64
+
+	Batch BatchPolicy
+}
+
+// BatchPolicy controls how long the logger waits to group transactions into a
+// single commit.
+//
+// Once there is a pending transaction, the logger commits as soon as any of
+// the following holds: MaxWait has passed, at least MaxBatch updates are
+// pending (if MaxBatch is non-zero), or some writer is waiting for durability
+// (if CommitIfWaiting is set). The logger also commits whenever a writer is
+// blocked waiting for space in the log, so a MaxBatch larger than the log's
+// capacity does not stall writers. The zero BatchPolicy commits immediately.
+type BatchPolicy struct {
+	MaxBatch        uint64
+	MaxWait         time.Duration
+	CommitIfWaiting bool
+}
+
+// Default number of blocks in the log.
+const defaultLogSize uint64 = 511
+
+// DefaultOptions places a log of defaultLogSize blocks at the start of d and
+// uses the rest of the disk for data.
+func DefaultOptions(d disk.Disk) Options {
+	dataStart := 1 + defaultLogSize
+	var dataSize uint64 = 0
+	if d.Size() > dataStart {
+		dataSize = d.Size() - dataStart
+	}
+	return Options{
+		LogStart:  0,
+		LogSize:   defaultLogSize,
+		DataStart: dataStart,
+		DataSize:  dataSize,
+	}
+}
+
+// capacity returns the maximum number of updates in the log
+func (opts Options) capacity() uint64 {
+	return logCapacity(opts.LogSize)
+}
+
+func (opts Options) logEnd() uint64 {
+	return opts.LogStart + 1 + opts.LogSize
+}
+
+func (opts Options) dataEnd() uint64 {
+	return opts.DataStart + opts.DataSize
+}
+
+// DefaultSplitOptions uses all of logDisk for the log and all of dataDisk for
+// data, for use with OpenSplit.
+func DefaultSplitOptions(logDisk disk.Disk, dataDisk disk.Disk) Options {
+	var logSize uint64 = 0
+	if logDisk.Size() > 0 {
+		logSize = logDisk.Size() - 1
+	}
+	return Options{
+		LogStart:  0,
+		LogSize:   logSize,
+		DataStart: 0,
+		DataSize:  dataDisk.Size(),
+	}
+}
+
+// validate checks that opts describes a sensible layout with a log disk of
+// logDiskSize blocks and a data disk of dataDiskSize blocks, which are the
+// same disk if sameDisk is set
+func (opts Options) validate(logDiskSize uint64, dataDiskSize uint64, sameDisk bool) error {
+	if opts.capacity() == 0 {
+		return fmt.Errorf("%w: log size %d is too small",
+			ErrInvalidLayout, opts.LogSize)
+	}
+	if opts.logEnd() > logDiskSize || opts.logEnd() < opts.LogStart {
+		return fmt.Errorf("%w: log [%d, %d) does not fit on disk of size %d",
+			ErrInvalidLayout, opts.LogStart, opts.logEnd(), logDiskSize)
+	}
+	if opts.dataEnd() > dataDiskSize || opts.dataEnd() < opts.DataStart {
+		return fmt.Errorf("%w: data [%d, %d) does not fit on disk of size %d",
+			ErrInvalidLayout, opts.DataStart, opts.dataEnd(), dataDiskSize)
+	}
+	if sameDisk && opts.DataStart < opts.logEnd() && opts.LogStart < opts.dataEnd() {
+		return fmt.Errorf("%w: data [%d, %d) overlaps log [%d, %d)",
+			ErrInvalidLayout, opts.DataStart, opts.dataEnd(),
+			opts.LogStart, opts.logEnd())
+	}
+	return nil
+}
+
+// validAddrs checks that every update in upds is to the data region
+func (opts Options) validAddrs(upds []Update) bool {
+	var ok = true
+	for _, u := range upds {
+		if u.Addr < opts.DataStart || u.Addr >= opts.dataEnd() {
+			ok = false
+		}
+	}
+	return ok
+}
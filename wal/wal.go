@@ -1,37 +1,156 @@
 package wal
 
 import (
+	"errors"
 	"sync"
 
 	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/errs"
 )
 
+// ErrClosed is returned for transactions submitted after Close.
+var ErrClosed = errors.New("wal: log is closed")
+
+// ErrInvalidAddr is returned for transactions that write outside the data
+// region.
+var ErrInvalidAddr = errors.New("wal: write outside data region")
+
+// Update is a single block write, to be applied atomically along with the
+// other updates in the same transaction.
+type Update struct {
+	Addr  uint64
+	Block disk.Block
+}
+
 type Log struct {
 	// read-only state
-	d disk.Disk
+	d    disk.Disk // data device, where updates are installed
+	opts Options
+
+	m *sync.Mutex
+	// signalled when l.pending becomes non-empty, and when the logger might
+	// want to stop batching
+	condLogger *sync.Cond
+	// signalled when l.pending shrinks, freeing up space in the log
+	condSpace *sync.Cond
+	// signalled when l.diskEnd advances
+	condDurable *sync.Cond
+	// signalled when l.installQueue becomes non-empty, and when the logger
+	// exits
+	condInstall *sync.Cond
+	// signalled when l.installedPos advances
+	condInstalled *sync.Cond
+	// signalled when the logger or installer exits
+	condShut *sync.Cond
 
-	m       *sync.Mutex
 	diskEnd uint64
-	pending []update
+	pending []Update
+	// number of transactions in l.pending
+	pendingTxns uint64
+	// number of writers waiting for a transaction to become durable
+	waiters uint64
+	// number of writers waiting for space in l.pending
+	spaceWaiters uint64
+	stats        Stats
+	// logged batches waiting to be installed, oldest first
+	installQueue []installBatch
+	// log position up to which everything has been installed
+	installedPos uint64
+	// set by Close; no new transactions are accepted once set
+	shutdown bool
+	// set by the logger once it has drained l.pending and exited
+	loggerDone bool
+	// set by the installer once it has drained l.installQueue and exited
+	installerDone bool
 }
 
-func open(d disk.Disk) (*Log, *appender) {
+// open recovers the log on logDisk described by opts, installing to d
+//
+// Requires opts to be valid for logDisk and d.
+func open(logDisk disk.Disk, d disk.Disk, opts Options) (*Log, *appender, error) {
 	m := new(sync.Mutex)
-	app, upds := openAppender(d)
+	app, upds, err := openAppender(logDisk, opts.LogStart, opts.LogSize)
+	if err != nil {
+		return nil, nil, err
+	}
 	install(d, upds)
-	return &Log{d: d, m: m, diskEnd: 0, pending: []update{}}, app
+	return &Log{
+		d:             d,
+		opts:          opts,
+		m:             m,
+		condLogger:    sync.NewCond(m),
+		condSpace:     sync.NewCond(m),
+		condDurable:   sync.NewCond(m),
+		condInstall:   sync.NewCond(m),
+		condInstalled: sync.NewCond(m),
+		condShut:      sync.NewCond(m),
+		diskEnd:       0,
+		pending:       []Update{},
+		pendingTxns:   0,
+		waiters:       0,
+		spaceWaiters:  0,
+		stats:         Stats{},
+		installQueue:  []installBatch{},
+		installedPos:  app.end,
+		shutdown:      false,
+		loggerDone:    false,
+		installerDone: false,
+	}, app, nil
 }
 
-func Open(d disk.Disk) *Log {
-	l, app := open(d)
+// OpenWithOptions recovers the log on d laid out according to opts, and
+// starts its logger.
+//
+// Returns a *CorruptError without replaying anything if the log fails
+// verification.
+func OpenWithOptions(d disk.Disk, opts Options) (*Log, error) {
+	err := opts.validate(d.Size(), d.Size(), true)
+	if err != nil {
+		return nil, err
+	}
+	return start(d, d, opts)
+}
+
+// OpenSplit recovers a log stored on logDisk whose updates are installed to
+// dataDisk, and starts its logger.
+//
+// The log region in opts refers to logDisk and the data region to dataDisk.
+// Transactions are durable once they are on logDisk; Read and installation
+// only use dataDisk.
+func OpenSplit(logDisk disk.Disk, dataDisk disk.Disk, opts Options) (*Log, error) {
+	err := opts.validate(logDisk.Size(), dataDisk.Size(), false)
+	if err != nil {
+		return nil, err
+	}
+	return start(logDisk, dataDisk, opts)
+}
+
+func start(logDisk disk.Disk, d disk.Disk, opts Options) (*Log, error) {
+	l, app, err := open(logDisk, d, opts)
+	if err != nil {
+		return nil, err
+	}
 	go func() { l.logger(app) }()
+	go func() { l.installer() }()
+	return l, nil
+}
+
+// Open recovers the log on d using DefaultOptions.
+//
+// Panics if d is too small to hold the log or the log is corrupt.
+func Open(d disk.Disk) *Log {
+	l, err := OpenWithOptions(d, DefaultOptions(d))
+	if err != nil {
+		panic(err)
+	}
 	return l
 }
 
 // waitForSpaceAndLock waits until the log has space for numUpdates
 //
-// Requires numUpdates < maxLogSpace both to avoid int overflow and also for
-// progress (there will never be space otherwise).
+// Requires numUpdates <= l.opts.capacity() both to avoid int overflow and also
+// for progress (there will never be space otherwise).
 //
 // Acquires the lock in the process.
 //
@@ -40,51 +159,211 @@ func Open(d disk.Disk) *Log {
 func (l *Log) waitForSpaceAndLock(numUpdates uint64) {
 	l.m.Lock()
 	for {
-		if uint64(len(l.pending))+numUpdates <= maxLogSize {
+		if l.shutdown {
 			break
 		}
-		l.m.Unlock()
-		l.m.Lock()
+		if uint64(len(l.pending))+numUpdates <= l.opts.capacity() {
+			break
+		}
+		l.spaceWaiters = l.spaceWaiters + 1
+		// the logger might be holding off on committing, but only a commit
+		// frees up space
+		l.condLogger.Broadcast()
+		l.condSpace.Wait()
+		l.spaceWaiters = l.spaceWaiters - 1
 		continue
 	}
-	// establishes len(l.pending) + numUpdates <= maxLogSize
+	// establishes len(l.pending) + numUpdates <= l.opts.capacity(), unless the
+	// log has been shut down
 	return
 }
 
-func (l *Log) writePrepare(upds []update) (uint64, bool) {
-	if uint64(len(upds)) > maxLogSize {
-		return 0, false
+// copyUpdates returns a deep copy of upds
+func copyUpdates(upds []Update) []Update {
+	var upds2 = make([]Update, 0, len(upds))
+	for _, u := range upds {
+		upds2 = append(upds2, Update{Addr: u.Addr, Block: copyBlock(u.Block)})
 	}
+	return upds2
+}
+
+func (l *Log) writePrepare(upds []Update) (uint64, error) {
+	if uint64(len(upds)) > l.opts.capacity() {
+		return 0, errs.ErrTxnTooLarge
+	}
+	if !l.opts.validAddrs(upds) {
+		return 0, ErrInvalidAddr
+	}
+	// the logger and installer use these blocks after we return, so the caller
+	// must be free to reuse its own
+	upds2 := copyUpdates(upds)
 	l.waitForSpaceAndLock(uint64(len(upds)))
-	l.pending = append(l.pending, upds...)
+	if l.shutdown {
+		l.m.Unlock()
+		return 0, ErrClosed
+	}
+	l.pending = append(l.pending, upds2...)
+	l.pendingTxns = l.pendingTxns + 1
 	txnId := l.diskEnd + uint64(len(l.pending))
+	l.condLogger.Broadcast()
 	l.m.Unlock()
-	return txnId, true
+	return txnId, nil
 }
 
 func (l *Log) writeWait(txnId uint64) {
 	l.m.Lock()
-	for {
-		if l.diskEnd >= txnId {
-			// this establishes that the transaction has been committed durably
-			l.m.Unlock()
-			break
+	if l.diskEnd < txnId {
+		l.waiters = l.waiters + 1
+		// the logger might be holding off on committing until someone waits
+		l.condLogger.Broadcast()
+		for l.diskEnd < txnId {
+			l.condDurable.Wait()
 		}
-		// TODO: use a cond var
-		l.m.Unlock()
-		l.m.Lock()
+		l.waiters = l.waiters - 1
 	}
+	// this establishes that the transaction has been committed durably
+	l.m.Unlock()
 }
 
-func (l *Log) Write(upds []update) bool {
-	txnId, ok := l.writePrepare(upds)
-	if !ok {
-		return false
-	}
+// WriteAsyncErr atomically applies upds, without waiting for them to be
+// durable.
+//
+// Returns a transaction id to pass to Flush, or the same errors as WriteErr.
+// Subsequent reads observe upds even before they are durable. The log keeps
+// its own copy of upds, so the caller may reuse the blocks as soon as
+// WriteAsyncErr returns.
+func (l *Log) WriteAsyncErr(upds []Update) (uint64, error) {
+	return l.writePrepare(upds)
+}
+
+// WriteAsync atomically applies upds, without waiting for them to be durable.
+//
+// Returns a transaction id to pass to Flush, or false if the transaction is
+// too large to ever fit in the log, writes outside the data region, or the log
+// has been closed (see WriteAsyncErr).
+func (l *Log) WriteAsync(upds []Update) (uint64, bool) {
+	txnId, err := l.WriteAsyncErr(upds)
+	return txnId, err == nil
+}
+
+// Flush waits for the transaction txnId (and every transaction before it) to
+// be durable.
+func (l *Log) Flush(txnId uint64) {
 	l.writeWait(txnId)
-	return true
 }
 
+// FlushAll waits for every transaction accepted so far to be durable.
+func (l *Log) FlushAll() {
+	l.m.Lock()
+	txnId := l.diskEnd + uint64(len(l.pending))
+	l.m.Unlock()
+	l.writeWait(txnId)
+}
+
+// WriteErr atomically and durably applies upds to the disk.
+//
+// Returns errs.ErrTxnTooLarge if the transaction can never fit in the log,
+// ErrInvalidAddr if it writes outside the data region, or ErrClosed if the log
+// has been closed. Nothing is applied if WriteErr fails. The log keeps its own
+// copy of upds, so the caller may reuse the blocks once WriteErr returns.
+func (l *Log) WriteErr(upds []Update) error {
+	txnId, err := l.writePrepare(upds)
+	if err != nil {
+		return err
+	}
+	l.Flush(txnId)
+	return nil
+}
+
+// Write atomically and durably applies upds to the disk.
+//
+// Returns false if the transaction is too large to ever fit in the log, writes
+// outside the data region, or the log has been closed.
+func (l *Log) Write(upds []Update) bool {
+	return l.WriteErr(upds) == nil
+}
+
+// Close stops accepting new transactions, waits for all pending transactions
+// to become durable and be installed, and then stops the logger and
+// installer.
+//
+// Writes that have not been accepted by the time Close is called fail. Close
+// does not close the underlying disk.
+func (l *Log) Close() {
+	l.m.Lock()
+	l.shutdown = true
+	l.condLogger.Broadcast()
+	// wake up writers waiting for space so they can fail
+	l.condSpace.Broadcast()
+	for !(l.loggerDone && l.installerDone) {
+		l.condShut.Wait()
+	}
+	l.m.Unlock()
+}
+
+// Stats returns counters describing the log's commits so far.
+func (l *Log) Stats() Stats {
+	l.m.Lock()
+	stats := l.stats
+	l.m.Unlock()
+	return stats
+}
+
+// findUpdate returns the last write to a in upds, if any
+func findUpdate(upds []Update, a uint64) (disk.Block, bool) {
+	var b disk.Block
+	var ok bool = false
+	// search backwards so that the newest write wins
+	for i := uint64(len(upds)); i > 0; i-- {
+		u := upds[i-1]
+		if !ok && u.Addr == a {
+			b = u.Block
+			ok = true
+		}
+	}
+	return b, ok
+}
+
+func copyBlock(b disk.Block) disk.Block {
+	b2 := make(disk.Block, len(b))
+	copy(b2, b)
+	return b2
+}
+
+// readPending returns a copy of the most recent write to a that has not been
+// installed yet, if any
+//
+// The copy ensures callers cannot modify a queued update through the result.
+//
+// Requires the lock to be held.
+func (l *Log) readPending(a uint64) (disk.Block, bool) {
+	b, ok := findUpdate(l.pending, a)
+	if ok {
+		return copyBlock(b), true
+	}
+	// search the install queue from newest to oldest
+	for i := uint64(len(l.installQueue)); i > 0; i-- {
+		b2, ok2 := findUpdate(l.installQueue[i-1].upds, a)
+		if ok2 {
+			return copyBlock(b2), true
+		}
+	}
+	return nil, false
+}
+
+// Read returns the current value of block a, including the effect of any
+// transaction whose Write has returned (even if it has not been installed
+// yet).
 func (l *Log) Read(a uint64) disk.Block {
-	return l.d.Read(a)
+	l.m.Lock()
+	b, ok := l.readPending(a)
+	if ok {
+		l.m.Unlock()
+		return b
+	}
+	// a has no uninstalled writes, so the installer will not write to it
+	// while we hold the lock
+	b2 := l.d.Read(a)
+	l.m.Unlock()
+	return b2
 }
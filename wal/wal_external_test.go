@@ -0,0 +1,348 @@
+package wal_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/perennial-examples/errs"
+	"github.com/mit-pdos/perennial-examples/wal"
+)
+
+func mkBlock(b0 byte) disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	b[0] = b0
+	return b
+}
+
+func TestExternalWrite(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := wal.Open(d)
+	ok := log.Write([]wal.Update{
+		{Addr: 600, Block: mkBlock(1)},
+		{Addr: 601, Block: mkBlock(2)},
+	})
+	assert.True(ok, "write should succeed")
+	assert.Equal(byte(1), log.Read(600)[0])
+	assert.Equal(byte(2), log.Read(601)[0])
+
+	log = wal.Open(d)
+	assert.Equal(byte(1), log.Read(600)[0])
+	assert.Equal(byte(2), log.Read(601)[0])
+}
+
+func TestExternalWriteTooLarge(t *testing.T) {
+	d := disk.NewMemDisk(2000)
+	log := wal.Open(d)
+	var upds []wal.Update
+	for i := uint64(0); i < 1000; i++ {
+		upds = append(upds, wal.Update{Addr: 1000 + i, Block: mkBlock(1)})
+	}
+	assert.False(t, log.Write(upds), "transaction should not fit in the log")
+	assert.Equal(t, errs.ErrTxnTooLarge, log.WriteErr(upds))
+}
+
+func TestExternalWriteErr(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := wal.Open(d)
+	assert.NoError(log.WriteErr([]wal.Update{{Addr: 600, Block: mkBlock(1)}}))
+	assert.Equal(wal.ErrInvalidAddr,
+		log.WriteErr([]wal.Update{{Addr: 1, Block: mkBlock(1)}}))
+	log.Close()
+	assert.Equal(wal.ErrClosed,
+		log.WriteErr([]wal.Update{{Addr: 600, Block: mkBlock(2)}}))
+}
+
+func TestExternalWriteAsync(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := wal.Open(d)
+	var lastId uint64
+	for i := uint64(0); i < 20; i++ {
+		txnId, ok := log.WriteAsync([]wal.Update{
+			{Addr: 600 + i, Block: mkBlock(byte(i))},
+		})
+		assert.True(ok, "write should succeed")
+		assert.Greater(txnId, lastId, "transaction ids should increase")
+		lastId = txnId
+	}
+	assert.Equal(byte(19), log.Read(619)[0], "reads should see async writes")
+	log.Flush(lastId)
+
+	log.WriteAsync([]wal.Update{{Addr: 700, Block: mkBlock(1)}})
+	log.FlushAll()
+	log.Close()
+
+	log = wal.Open(d)
+	assert.Equal(byte(19), log.Read(619)[0], "flushed writes should be durable")
+	assert.Equal(byte(1), log.Read(700)[0], "flushed writes should be durable")
+	log.Close()
+}
+
+func TestExternalWriteAsyncErr(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := wal.Open(d)
+	txnId, err := log.WriteAsyncErr([]wal.Update{{Addr: 600, Block: mkBlock(1)}})
+	assert.NoError(err)
+	log.Flush(txnId)
+	var upds []wal.Update
+	for i := uint64(0); i < 1000; i++ {
+		upds = append(upds, wal.Update{Addr: 600 + i%300, Block: mkBlock(1)})
+	}
+	_, err = log.WriteAsyncErr(upds)
+	assert.Equal(errs.ErrTxnTooLarge, err)
+	_, err = log.WriteAsyncErr([]wal.Update{{Addr: 1, Block: mkBlock(1)}})
+	assert.Equal(wal.ErrInvalidAddr, err)
+	log.Close()
+	_, err = log.WriteAsyncErr([]wal.Update{{Addr: 600, Block: mkBlock(2)}})
+	assert.Equal(wal.ErrClosed, err)
+	assert.Equal(byte(1), d.Read(600)[0], "failed writes should not be applied")
+}
+
+func TestExternalWriteReuseBlock(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := wal.Open(d)
+	b := mkBlock(1)
+	log.Write([]wal.Update{{Addr: 600, Block: b}})
+	b[0] = 9
+	_, ok := log.WriteAsync([]wal.Update{{Addr: 601, Block: b}})
+	assert.True(ok)
+	b[0] = 10
+	assert.Equal(byte(1), log.Read(600)[0], "reusing the block should not change the write")
+	assert.Equal(byte(9), log.Read(601)[0])
+	log.Close()
+	assert.Equal(byte(1), d.Read(600)[0], "installed block should be unchanged")
+	assert.Equal(byte(9), d.Read(601)[0])
+}
+
+func TestExternalOptions(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(100)
+	opts := wal.Options{
+		LogStart:  50,
+		LogSize:   20,
+		DataStart: 0,
+		DataSize:  50,
+	}
+	log, err := wal.OpenWithOptions(d, opts)
+	assert.NoError(err)
+	assert.True(log.Write([]wal.Update{
+		{Addr: 0, Block: mkBlock(1)},
+		{Addr: 49, Block: mkBlock(2)},
+	}))
+	assert.False(log.Write([]wal.Update{{Addr: 55, Block: mkBlock(3)}}),
+		"should not write to the log region")
+	assert.False(log.Write([]wal.Update{{Addr: 80, Block: mkBlock(3)}}),
+		"should not write outside the data region")
+	var upds []wal.Update
+	for i := uint64(0); i < 21; i++ {
+		upds = append(upds, wal.Update{Addr: i, Block: mkBlock(4)})
+	}
+	assert.False(log.Write(upds), "transaction should not fit in the log")
+	log.Close()
+
+	log, err = wal.OpenWithOptions(d, opts)
+	assert.NoError(err)
+	assert.Equal(byte(1), log.Read(0)[0])
+	assert.Equal(byte(2), log.Read(49)[0])
+	log.Close()
+}
+
+func TestExternalOptionsInvalid(t *testing.T) {
+	d := disk.NewMemDisk(100)
+	for _, opts := range []wal.Options{
+		// data overlaps log
+		{LogStart: 0, LogSize: 20, DataStart: 20, DataSize: 80},
+		// log too large for disk
+		{LogStart: 90, LogSize: 20, DataStart: 0, DataSize: 90},
+		// data too large for disk
+		{LogStart: 0, LogSize: 20, DataStart: 21, DataSize: 80},
+		// empty log
+		{LogStart: 0, LogSize: 0, DataStart: 1, DataSize: 99},
+	} {
+		_, err := wal.OpenWithOptions(d, opts)
+		assert.True(t, errors.Is(err, wal.ErrInvalidLayout), "layout %+v", opts)
+	}
+}
+
+func TestExternalCorrupt(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := wal.Open(d)
+	log.Write([]wal.Update{{Addr: 600, Block: mkBlock(1)}})
+	log.Close()
+
+	d.Write(0, mkBlock(1))
+	_, err := wal.OpenWithOptions(d, wal.DefaultOptions(d))
+	var corrupt *wal.CorruptError
+	assert.True(errors.As(err, &corrupt), "should report corruption")
+	assert.Equal(uint64(0), corrupt.Addr)
+}
+
+func TestExternalLargeTransaction(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	opts := wal.Options{
+		LogStart:  0,
+		LogSize:   5000,
+		DataStart: 5001,
+		DataSize:  4999,
+	}
+	log, err := wal.OpenWithOptions(d, opts)
+	assert.NoError(err)
+	var upds []wal.Update
+	for i := uint64(0); i < 4000; i++ {
+		upds = append(upds, wal.Update{Addr: 5001 + i, Block: mkBlock(byte(i))})
+	}
+	assert.True(log.Write(upds), "large transaction should fit in the log")
+	log.Close()
+
+	log, err = wal.OpenWithOptions(d, opts)
+	assert.NoError(err)
+	assert.Equal(byte(3999%256), log.Read(5001 + 3999)[0])
+	log.Close()
+}
+
+func openBatched(t *testing.T, d disk.Disk, policy wal.BatchPolicy) *wal.Log {
+	opts := wal.DefaultOptions(d)
+	opts.Batch = policy
+	log, err := wal.OpenWithOptions(d, opts)
+	assert.NoError(t, err)
+	return log
+}
+
+func TestExternalBatchMaxBatch(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := openBatched(t, d, wal.BatchPolicy{
+		MaxBatch: 10,
+		MaxWait:  time.Hour,
+	})
+	for i := uint64(0); i < 10; i++ {
+		log.WriteAsync([]wal.Update{{Addr: 600 + i, Block: mkBlock(1)}})
+	}
+	log.FlushAll()
+	stats := log.Stats()
+	assert.Equal(uint64(1), stats.Batches, "should commit in one batch")
+	assert.Equal(uint64(10), stats.Txns)
+	assert.Equal(10.0, stats.AvgBatchSize())
+	log.Close()
+}
+
+func TestExternalBatchMaxWait(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := openBatched(t, d, wal.BatchPolicy{
+		MaxWait: 10 * time.Millisecond,
+	})
+	for i := uint64(0); i < 3; i++ {
+		log.WriteAsync([]wal.Update{{Addr: 600 + i, Block: mkBlock(1)}})
+	}
+	// without CommitIfWaiting, this waits for the timeout
+	log.FlushAll()
+	assert.Equal(uint64(1), log.Stats().Batches, "should commit in one batch")
+	log.Close()
+}
+
+func TestExternalBatchCommitIfWaiting(t *testing.T) {
+	d := disk.NewMemDisk(1000)
+	log := openBatched(t, d, wal.BatchPolicy{
+		MaxWait:         time.Hour,
+		CommitIfWaiting: true,
+	})
+	// would take an hour if the logger did not notice the waiting writer
+	log.Write([]wal.Update{{Addr: 600, Block: mkBlock(1)}})
+	log.Close()
+}
+
+func TestExternalBatchLargerThanLog(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(2000)
+	log := openBatched(t, d, wal.BatchPolicy{
+		MaxBatch: 10000,
+		MaxWait:  time.Hour,
+	})
+	// more updates than fit in the log; writers that run out of space should
+	// make the logger commit rather than wait for MaxWait
+	for i := uint64(0); i < 600; i++ {
+		_, ok := log.WriteAsync([]wal.Update{{Addr: 600 + i, Block: mkBlock(1)}})
+		assert.True(ok)
+	}
+	assert.GreaterOrEqual(log.Stats().Batches, uint64(1))
+	log.Close()
+	assert.Equal(byte(1), d.Read(1199)[0])
+}
+
+func TestExternalBatchConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := openBatched(t, d, wal.BatchPolicy{
+		MaxBatch:        8,
+		MaxWait:         time.Millisecond,
+		CommitIfWaiting: false,
+	})
+	var wg sync.WaitGroup
+	for i := uint64(0); i < 8; i++ {
+		wg.Add(1)
+		go func(i uint64) {
+			for j := uint64(0); j < 20; j++ {
+				log.Write([]wal.Update{{Addr: 600 + i, Block: mkBlock(byte(j))}})
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	stats := log.Stats()
+	assert.Equal(uint64(8*20), stats.Txns)
+	assert.Greater(stats.AvgBatchSize(), 1.0, "concurrent writes should be batched")
+	for i := uint64(0); i < 8; i++ {
+		assert.Equal(byte(19), log.Read(600 + i)[0])
+	}
+	log.Close()
+}
+
+func TestExternalSplit(t *testing.T) {
+	assert := assert.New(t)
+	logDisk := disk.NewMemDisk(100)
+	dataDisk := disk.NewMemDisk(100)
+	opts := wal.DefaultSplitOptions(logDisk, dataDisk)
+	log, err := wal.OpenSplit(logDisk, dataDisk, opts)
+	assert.NoError(err)
+	assert.True(log.Write([]wal.Update{
+		{Addr: 0, Block: mkBlock(1)},
+		{Addr: 99, Block: mkBlock(2)},
+	}), "data region should cover all of the data disk")
+	assert.False(log.Write([]wal.Update{{Addr: 100, Block: mkBlock(3)}}))
+	log.Close()
+	assert.Equal(byte(1), dataDisk.Read(0)[0], "should install to data disk")
+	assert.Equal(byte(0), logDisk.Read(99)[0], "should not install to log disk")
+
+	log, err = wal.OpenSplit(logDisk, dataDisk, opts)
+	assert.NoError(err)
+	assert.Equal(byte(2), log.Read(99)[0])
+	log.Close()
+}
+
+func TestExternalSplitRecover(t *testing.T) {
+	assert := assert.New(t)
+	logDisk := disk.NewMemDisk(100)
+	dataDisk := disk.NewMemDisk(100)
+	opts := wal.DefaultSplitOptions(logDisk, dataDisk)
+	log, _ := wal.OpenSplit(logDisk, dataDisk, opts)
+	log.Write([]wal.Update{{Addr: 5, Block: mkBlock(1)}})
+	log.Close()
+
+	// simulate losing the installed copy; recovery replays from the log disk
+	dataDisk.Write(5, mkBlock(0))
+	log, _ = wal.OpenSplit(logDisk, dataDisk, opts)
+	assert.Equal(byte(1), log.Read(5)[0])
+	log.Close()
+}
@@ -7,36 +7,166 @@ import (
 	"github.com/tchajed/goose/machine/disk"
 )
 
-func mkUpdate(addr uint64, b0 byte) update {
-	return update{addr: addr, b: mkBlock(b0)}
+func mkUpdate(addr uint64, b0 byte) Update {
+	return Update{Addr: addr, Block: mkBlock(b0)}
 }
 
 func TestLogBasic(t *testing.T) {
 	d := disk.NewMemDisk(1000)
 	log := Open(d)
-	log.Write([]update{
-		mkUpdate(2, 0),
-		mkUpdate(3, 1),
+	log.Write([]Update{
+		mkUpdate(602, 0),
+		mkUpdate(603, 1),
 	})
-	log.Write([]update{
-		mkUpdate(4, 2),
-		mkUpdate(2, 3),
+	log.Write([]Update{
+		mkUpdate(604, 2),
+		mkUpdate(602, 3),
 	})
-	assert.Equal(t, byte(3), log.Read(2)[0])
+	assert.Equal(t, byte(3), log.Read(602)[0])
 }
 
 func TestLogRecover(t *testing.T) {
 	d := disk.NewMemDisk(1000)
 	log := Open(d)
-	log.Write([]update{
-		mkUpdate(2, 0),
-		mkUpdate(3, 1),
+	log.Write([]Update{
+		mkUpdate(602, 0),
+		mkUpdate(603, 1),
 	})
-	log.Write([]update{
-		mkUpdate(4, 2),
-		mkUpdate(2, 3),
+	log.Write([]Update{
+		mkUpdate(604, 2),
+		mkUpdate(602, 3),
 	})
 
 	log = Open(d)
-	assert.Equal(t, byte(3), log.Read(2)[0])
+	assert.Equal(t, byte(3), log.Read(602)[0])
+}
+
+func TestLogReadPending(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	// no logger running, so writes stay pending
+	log, _, _ := open(d, d, DefaultOptions(d))
+	log.writePrepare([]Update{
+		mkUpdate(602, 1),
+		mkUpdate(603, 2),
+	})
+	log.writePrepare([]Update{
+		mkUpdate(602, 3),
+	})
+	assert.Equal(byte(3), log.Read(602)[0], "newest pending write should win")
+	assert.Equal(byte(2), log.Read(603)[0])
+	assert.Equal(byte(0), d.Read(602)[0], "pending write should not be installed")
+}
+
+func TestLogReadPendingCopy(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	// no logger running, so writes stay pending
+	log, _, _ := open(d, d, DefaultOptions(d))
+	log.writePrepare([]Update{mkUpdate(602, 1)})
+	b := log.Read(602)
+	b[0] = 7
+	assert.Equal(byte(1), log.Read(602)[0],
+		"modifying a read block should not change the pending write")
+	assert.Equal(byte(1), log.pending[0].Block[0])
+}
+
+func TestLogClose(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log := Open(d)
+	txnId, _ := log.writePrepare([]Update{
+		mkUpdate(602, 1),
+		mkUpdate(603, 2),
+	})
+	log.Close()
+	assert.GreaterOrEqual(log.diskEnd, txnId, "Close should drain pending writes")
+	assert.Equal(byte(1), d.Read(602)[0], "Close should install pending writes")
+	assert.False(log.Write([]Update{mkUpdate(604, 3)}),
+		"writes after Close should fail")
+
+	log = Open(d)
+	assert.Equal(byte(2), log.Read(603)[0])
+	log.Close()
+}
+
+func TestLogManyTransactions(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(2000)
+	log := Open(d)
+	// enough transactions to wrap around the log several times
+	for i := uint64(0); i < 3*defaultLogSize; i++ {
+		log.Write([]Update{
+			mkUpdate(600+i%100, byte(i)),
+			mkUpdate(800+i%100, byte(i+1)),
+		})
+	}
+	log.Close()
+
+	log = Open(d)
+	for i := uint64(3*defaultLogSize - 100); i < 3*defaultLogSize; i++ {
+		assert.Equal(byte(i), log.Read(600 + i%100)[0])
+		assert.Equal(byte(i+1), log.Read(800 + i%100)[0])
+	}
+	log.Close()
+}
+
+func TestInspect(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log, app, _ := open(d, d, DefaultOptions(d))
+	app.Append([]Update{mkUpdate(602, 1), mkUpdate(603, 2)})
+	app.Append([]Update{mkUpdate(602, 3)})
+	state, err := Inspect(d, log.opts)
+	assert.NoError(err)
+	assert.Equal(uint64(0), state.Start)
+	assert.Equal(uint64(5), state.End)
+	assert.Equal([]Entry{
+		{Pos: 1, LogAddr: 2, Update: mkUpdate(602, 1)},
+		{Pos: 2, LogAddr: 3, Update: mkUpdate(603, 2)},
+		{Pos: 4, LogAddr: 5, Update: mkUpdate(602, 3)},
+	}, state.Entries)
+}
+
+func TestLogInstallBehind(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	log, app, _ := open(d, d, DefaultOptions(d))
+	// run only the logger, so nothing is installed
+	go log.logger(app)
+	log.Write([]Update{mkUpdate(602, 1), mkUpdate(603, 2)})
+	log.Write([]Update{mkUpdate(602, 3)})
+	assert.Equal(byte(0), d.Read(602)[0], "should not be installed")
+	assert.Equal(byte(3), log.Read(602)[0], "should read from install queue")
+	assert.Equal(byte(2), log.Read(603)[0], "should read from install queue")
+
+	// crash and recover
+	log = Open(d)
+	assert.Equal(byte(3), log.Read(602)[0])
+	assert.Equal(byte(2), log.Read(603)[0])
+	log.Close()
+}
+
+func TestLogSmallLog(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(1000)
+	opts := DefaultOptions(d)
+	opts.LogSize = 6
+	log, err := OpenWithOptions(d, opts)
+	assert.NoError(err)
+	// the logger has to wait for the installer to reclaim space
+	for i := uint64(0); i < 100; i++ {
+		log.Write([]Update{
+			mkUpdate(600+i%10, byte(i)),
+			mkUpdate(700+i%10, byte(i)),
+		})
+	}
+	log.Close()
+
+	log, _ = OpenWithOptions(d, opts)
+	for i := uint64(90); i < 100; i++ {
+		assert.Equal(byte(i), log.Read(600 + i%10)[0])
+		assert.Equal(byte(i), log.Read(700 + i%10)[0])
+	}
+	log.Close()
 }